@@ -16,15 +16,21 @@ package xormadapter
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
 	"github.com/lib/pq"
 	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
 )
 
 // TableName  if tableName=="" , adapter will use default tablename "casbin_rule".
@@ -50,13 +56,89 @@ type CasbinRule struct {
 
 // Adapter represents the Xorm adapter for policy storage.
 type Adapter struct {
-	driverName     string
-	dataSourceName string
-	dbSpecified    bool
-	isFiltered     bool
-	engine         *xorm.Engine
-	tablePrefix    string
-	tableName      string
+	driverName       string
+	dataSourceName   string
+	dbSpecified      bool
+	engine           *xorm.Engine
+	tablePrefix      string
+	tableName        string
+	changeLog        bool
+	history          bool
+	audit            bool
+	auditActorKey    interface{}
+	pollInterval     time.Duration
+	optimistic       bool
+	lockTimeout      time.Duration
+	ruleType         reflect.Type
+	ruleHook         RuleHook
+	columns          []string
+	existingTable    bool
+	skipCreateDB     bool
+	skipSync         bool
+	columnTypes      map[string]ColumnType
+	indexStrategy    IndexStrategy
+	compositeIndexes [][]string
+	schema           string
+	charset          string
+	collation        string
+	storeEngine      string
+	routes           map[string]string
+	tenantColumn     string
+	tenantValue      string
+	tenantKey        interface{}
+	features         []Feature
+
+	// The state shared with the adapters returned by ForEnforcer, and the policy loaded through
+	// this adapter, which is specific to it.
+	*sharedState
+	*loadedPolicy
+	// owner is the adapter closing the engine when released, kept alive by ForEnforcer.
+	owner *Adapter
+}
+
+// sharedState is the state of an adapter changed after its creation, shared with the
+// adapters returned by ForEnforcer.
+type sharedState struct {
+	instanceOnce  sync.Once
+	instance      string
+	subscribersMu sync.Mutex
+	subscribers   map[*subscription]struct{}
+
+	// watcherMu guards watcher.
+	watcherMu sync.RWMutex
+	watcher   *Watcher
+}
+
+// ErrSharedAdapter is returned when the policy saved isn't the one loaded last through the
+// adapter, which is shared by several enforcers instead of each using its own, see ForEnforcer.
+var ErrSharedAdapter = errors.New("the adapter is shared by several enforcers, see ForEnforcer")
+
+// loadedPolicy records the policy loaded by an enforcer.
+type loadedPolicy struct {
+	// mu guards model, isFiltered, filter, loadedTenant and loadedVersion.
+	mu sync.RWMutex
+	// model is the model the policy was loaded into last, which identifies the enforcer.
+	model      model.Model
+	isFiltered bool
+	filter     Filter
+	// loadedTenant is the tenant whose version is loadedVersion, empty if none has been loaded.
+	loadedTenant  string
+	loadedVersion int64
+}
+
+// ForEnforcer returns an adapter sharing the engine, the options, the watcher and the
+// subscribers of a, with its own record of the loaded policy: the filter of the last
+// LoadFilteredPolicy, used by SaveFilteredPolicy, and the version of the policy checked by
+// SavePolicy with WithOptimisticLocking. An adapter shared by several enforcers recognizes
+// them by their models, and fails with ErrSharedAdapter instead of saving the policy of an
+// enforcer within the filter or the version loaded by another.
+func (a *Adapter) ForEnforcer() *Adapter {
+	h := *a
+	h.loadedPolicy = &loadedPolicy{}
+	if h.owner == nil {
+		h.owner = a
+	}
+	return &h
 }
 
 // Filter  .
@@ -91,6 +173,8 @@ func NewAdapter(driverName string, dataSourceName string, dbSpecified ...bool) (
 	a := &Adapter{
 		driverName:     driverName,
 		dataSourceName: dataSourceName,
+		sharedState:    &sharedState{},
+		loadedPolicy:   &loadedPolicy{},
 	}
 
 	if len(dbSpecified) == 0 {
@@ -120,6 +204,8 @@ func NewAdapterWithTableName(driverName string, dataSourceName string, tableName
 		dataSourceName: dataSourceName,
 		tableName:      tableName,
 		tablePrefix:    tablePrefix,
+		sharedState:    &sharedState{},
+		loadedPolicy:   &loadedPolicy{},
 	}
 
 	if len(dbSpecified) == 0 {
@@ -145,7 +231,9 @@ func NewAdapterWithTableName(driverName string, dataSourceName string, tableName
 // NewAdapterByEngine  .
 func NewAdapterByEngine(engine *xorm.Engine) (*Adapter, error) {
 	a := &Adapter{
-		engine: engine,
+		engine:       engine,
+		sharedState:  &sharedState{},
+		loadedPolicy: &loadedPolicy{},
 	}
 
 	err := a.createTable()
@@ -159,9 +247,11 @@ func NewAdapterByEngine(engine *xorm.Engine) (*Adapter, error) {
 // NewAdapterByEngineWithTableName  .
 func NewAdapterByEngineWithTableName(engine *xorm.Engine, tableName string, tablePrefix string) (*Adapter, error) {
 	a := &Adapter{
-		engine:      engine,
-		tableName:   tableName,
-		tablePrefix: tablePrefix,
+		engine:       engine,
+		tableName:    tableName,
+		tablePrefix:  tablePrefix,
+		sharedState:  &sharedState{},
+		loadedPolicy: &loadedPolicy{},
 	}
 
 	err := a.createTable()
@@ -179,6 +269,11 @@ func (a *Adapter) getFullTableName() string {
 	return a.tableName
 }
 
+// ruleTableName returns the name of the policy table as used in the database.
+func (a *Adapter) ruleTableName() string {
+	return (&CasbinRule{tableName: a.getFullTableName()}).TableName()
+}
+
 func (a *Adapter) createDatabase() error {
 	var err error
 	var engine *xorm.Engine
@@ -220,8 +315,10 @@ func (a *Adapter) open() error {
 			return err
 		}
 	} else {
-		if err = a.createDatabase(); err != nil {
-			return err
+		if !a.skipCreateDB {
+			if err = a.createDatabase(); err != nil {
+				return err
+			}
 		}
 
 		if a.driverName == "postgres" {
@@ -236,17 +333,162 @@ func (a *Adapter) open() error {
 		}
 	}
 
+	if a.schema != "" && engine.Dialect().URI().DBType == schemas.POSTGRES {
+		engine.SetSchema(a.schema)
+	}
 	a.engine = engine
 
 	return a.createTable()
 }
 
+// createTable creates the policy table and the tables of the enabled features,
+// holding the lock of the policy table.
 func (a *Adapter) createTable() error {
-	return a.engine.Sync2(&CasbinRule{tableName: a.getFullTableName()})
+	return a.changeSchema(a.syncTables)
+}
+
+// changeSchema runs fn creating tables in a transaction holding the lock of the policy table.
+func (a *Adapter) changeSchema(fn func(session *xorm.Session) error) error {
+	if !a.skipSync {
+		return a.withLock(context.Background(), fn)
+	}
+
+	// Nothing is created, the lock isn't needed to check the options.
+	session := a.engine.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if err := fn(session); err != nil {
+		_ = session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+// sync creates or updates the tables of beans through session, unless the schema is managed
+// outside the adapter.
+func (a *Adapter) sync(session *xorm.Session, beans ...interface{}) error {
+	if a.skipSync {
+		return nil
+	}
+	for _, bean := range beans {
+		custom, err := a.customSync(bean)
+		if err != nil {
+			return err
+		}
+		if custom {
+			err = a.syncTyped(session, bean)
+		} else {
+			err = a.syncBean(session, bean)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncBean creates the table of bean with Sync2, or adds its missing columns and indexes.
+// Sync2 reads an existing table outside of the transaction of session, which would wait
+// for the connection holding the lock on an engine with a single connection.
+func (a *Adapter) syncBean(session *xorm.Session, bean interface{}) error {
+	tableName := a.engine.TableName(bean)
+	exist, err := session.IsTableExist(tableName)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return session.Sync2(bean)
+	}
+
+	table, err := a.engine.TableInfo(bean)
+	if err != nil {
+		return err
+	}
+	dialect := a.engine.Dialect()
+	columns, _, err := dialect.GetColumns(queryer(session), context.Background(), tableName)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(columns))
+	for _, name := range columns {
+		existing[strings.ToLower(name)] = true
+	}
+	for _, col := range table.Columns() {
+		if !existing[strings.ToLower(col.Name)] {
+			if _, err = session.Exec(dialect.AddColumnSQL(tableName, col)); err != nil {
+				return err
+			}
+		}
+	}
+
+	indexes, err := dialect.GetIndexes(queryer(session), context.Background(), tableName)
+	if err != nil {
+		return err
+	}
+	for name, index := range table.Indexes {
+		if _, ok := indexes[name]; !ok {
+			if _, err = session.Exec(dialect.CreateIndexSQL(tableName, index)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (a *Adapter) dropTable() error {
-	return a.engine.DropTables(&CasbinRule{tableName: a.getFullTableName()})
+// ownsTable reports whether the adapter may drop and create the policy table,
+// which isn't the case of the tables shared by tenants.
+func (a *Adapter) ownsTable() bool {
+	return !a.existingTable && !a.skipSync && a.tenantColumn == ""
+}
+
+func (a *Adapter) syncTables(session *xorm.Session) error {
+	if err := a.checkSchemaOptions(); err != nil {
+		return err
+	}
+	if a.existingTable {
+		if a.ruleType != nil {
+			return errors.New("a custom rule type can't be used with an existing table")
+		}
+		if len(a.columns) > len(ruleColumns) {
+			return fmt.Errorf("the policy table can't have more than %d columns", len(ruleColumns))
+		}
+	} else {
+		for _, table := range a.ruleTables() {
+			bean, err := a.ruleBeanOf(table)
+			if err != nil {
+				return err
+			}
+			if err = a.sync(session, bean); err != nil {
+				return err
+			}
+		}
+	}
+	if a.changeLog {
+		if err := a.createChangeLogTables(session); err != nil {
+			return err
+		}
+	}
+	if a.audit {
+		if err := a.sync(session, &AuditRecord{tableName: a.auditTableName()}); err != nil {
+			return err
+		}
+	}
+	if a.optimistic {
+		return a.createSeqTable(session)
+	}
+	return nil
+}
+
+func (a *Adapter) dropTable(session *xorm.Session) error {
+	for _, table := range a.ruleTables() {
+		if err := session.DropTable(&CasbinRule{tableName: table}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func loadPolicyLine(line *CasbinRule, model model.Model) {
@@ -277,21 +519,32 @@ func (a *Adapter) LoadPolicy(model model.Model) error {
 
 // LoadPolicyCtx loads policy from database.
 func (a *Adapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	version, err := a.readVersion(ctx, tenant)
+	if err != nil {
+		return err
+	}
+
 	lines := make([]*CasbinRule, 0, 64)
 
-	if err := a.engine.Context(ctx).Table(&CasbinRule{tableName: a.getFullTableName()}).Find(&lines); err != nil {
-		return err
+	for _, table := range a.ruleTables() {
+		if err := a.rules(a.engine.Context(ctx), table, tenant).Find(&lines); err != nil {
+			return err
+		}
 	}
 
 	for _, line := range lines {
 		loadPolicyLine(line, model)
 	}
-
+	a.setLoaded(model, false, Filter{}, tenant, version)
 	return nil
 }
 
 func (a *Adapter) genPolicyLine(ptype string, rule []string) *CasbinRule {
-	line := CasbinRule{Ptype: ptype, tableName: a.getFullTableName()}
+	line := CasbinRule{Ptype: ptype, tableName: a.tableFor(ptype)}
 
 	l := len(rule)
 	if l > 0 {
@@ -322,14 +575,20 @@ func (a *Adapter) SavePolicy(model model.Model) error {
 }
 
 // SavePolicyCtx saves policy to database.
+// With WithOptimisticLocking, it fails with ErrPolicyConflict if the policy has been
+// changed by another adapter since it was loaded, see ForceSavePolicyCtx.
 func (a *Adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
-	err := a.dropTable()
-	if err != nil {
-		return err
-	}
-	err = a.createTable()
-	if err != nil {
-		return err
+	return a.savePolicy(ctx, model, false)
+}
+
+func (a *Adapter) savePolicy(ctx context.Context, model model.Model, force bool) error {
+	if a.optimistic && !force {
+		a.mu.RLock()
+		err := a.checkLoaded(model)
+		a.mu.RUnlock()
+		if err != nil {
+			return err
+		}
 	}
 
 	lines := make([]*CasbinRule, 0, 64)
@@ -348,14 +607,83 @@ func (a *Adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
 		}
 	}
 
+	// The lock keeps the saves and the schema changes of other processes from interleaving,
+	// the rules are replaced in its transaction. On MySQL, the statements recreating the
+	// table commit it implicitly.
+	var tx *policyTx
+	err := a.withLock(ctx, func(session *xorm.Session) error {
+		recreate, err := a.recreatesTable(session)
+		if err != nil {
+			return err
+		}
+		if recreate {
+			err = a.dropTable(session)
+			if err != nil {
+				return err
+			}
+			err = a.syncTables(session)
+			if err != nil {
+				return err
+			}
+		}
+		tx, err = a.runTransaction(ctx, session, func(tx *policyTx) error {
+			return tx.replacePolicy(lines, force, !recreate)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	a.committed(tx)
+	return nil
+}
+
+// recreatesTable reports whether SavePolicy drops and recreates the policy table, instead of
+// deleting the rules, which keeps the changes of the migrations applied to the table if any.
+// With the audit log, the rules are deleted so that the removed ones can be recorded.
+func (a *Adapter) recreatesTable(session *xorm.Session) (bool, error) {
+	if !a.ownsTable() || a.optimistic || a.audit {
+		return false, nil
+	}
+	migrated, err := a.migrated(session)
+	return !migrated, err
+}
+
+// replacePolicy replaces the rules by lines, deleting them first if deleteRules.
+func (tx *policyTx) replacePolicy(lines []*CasbinRule, force bool, deleteRules bool) error {
+	a := tx.adapter
+	// The rules are deleted in the transaction checking the version,
+	// instead of dropping the table, so that no other change can slip in between.
+	if a.optimistic && !force {
+		a.mu.RLock()
+		loadedTenant, loadedVersion := a.loadedTenant, a.loadedVersion
+		a.mu.RUnlock()
+		if loadedTenant != "" && tx.tenant != loadedTenant || tx.version != loadedVersion+1 {
+			return ErrPolicyConflict
+		}
+	}
+	var removed []*CasbinRule
+	if deleteRules {
+		for _, table := range a.ruleTables() {
+			if a.audit {
+				if err := a.rules(tx.Session, table, tx.tenant).Find(&removed); err != nil {
+					return err
+				}
+			}
+			if _, err := a.scope(tx.Where("1 = 1"), tx.tenant).Delete(&CasbinRule{tableName: table}); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx.save(removed, lines)
+
 	// check whether the policy is empty
 	if len(lines) == 0 {
 		return nil
 	}
 
-	_, err = a.engine.Context(ctx).Insert(&lines)
-
-	return err
+	return tx.insertLines(lines)
 }
 
 // AddPolicy adds a policy rule to the storage.
@@ -365,24 +693,22 @@ func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
 
 // AddPolicyCtx adds a policy rule to the storage.
 func (a *Adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
-	line := a.genPolicyLine(ptype, rule)
-	_, err := a.engine.Context(ctx).InsertOne(line)
-	return err
+	return a.transaction(ctx, func(tx *policyTx) error {
+		line := a.genPolicyLine(ptype, rule)
+		return tx.insert(line)
+	})
 }
 
 // AddPolicies adds multiple policy rule to the storage.
 func (a *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
-	_, err := a.engine.Transaction(func(tx *xorm.Session) (interface{}, error) {
-		for _, rule := range rules {
-			line := a.genPolicyLine(ptype, rule)
-			_, err := tx.InsertOne(line)
-			if err != nil {
-				return nil, err
-			}
-		}
-		return nil, nil
+	return a.AddPoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// AddPoliciesCtx adds multiple policy rule to the storage.
+func (a *Adapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	return a.transaction(ctx, func(tx *policyTx) error {
+		return tx.addPolicies(ptype, rules)
 	})
-	return err
 }
 
 // RemovePolicy removes a policy rule from the storage.
@@ -392,24 +718,22 @@ func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
 
 // RemovePolicyCtx removes a policy rule from the storage.
 func (a *Adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
-	line := a.genPolicyLine(ptype, rule)
-	_, err := a.engine.Context(ctx).Delete(line)
-	return err
+	return a.transaction(ctx, func(tx *policyTx) error {
+		line := a.genPolicyLine(ptype, rule)
+		return tx.delete(line)
+	})
 }
 
 // RemovePolicies removes multiple policy rule from the storage.
 func (a *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
-	_, err := a.engine.Transaction(func(tx *xorm.Session) (interface{}, error) {
-		for _, rule := range rules {
-			line := a.genPolicyLine(ptype, rule)
-			_, err := tx.Delete(line)
-			if err != nil {
-				return nil, nil
-			}
-		}
-		return nil, nil
+	return a.RemovePoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesCtx removes multiple policy rule from the storage.
+func (a *Adapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	return a.transaction(ctx, func(tx *policyTx) error {
+		return tx.removePolicies(ptype, rules)
 	})
-	return err
 }
 
 // RemoveFilteredPolicy removes policy rules that match the filter from the storage.
@@ -419,30 +743,9 @@ func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int,
 
 // RemoveFilteredPolicyCtx removes policy rules that match the filter from the storage.
 func (a *Adapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
-	line := CasbinRule{Ptype: ptype, tableName: a.getFullTableName()}
-
-	idx := fieldIndex + len(fieldValues)
-	if fieldIndex <= 0 && idx > 0 {
-		line.V0 = fieldValues[0-fieldIndex]
-	}
-	if fieldIndex <= 1 && idx > 1 {
-		line.V1 = fieldValues[1-fieldIndex]
-	}
-	if fieldIndex <= 2 && idx > 2 {
-		line.V2 = fieldValues[2-fieldIndex]
-	}
-	if fieldIndex <= 3 && idx > 3 {
-		line.V3 = fieldValues[3-fieldIndex]
-	}
-	if fieldIndex <= 4 && idx > 4 {
-		line.V4 = fieldValues[4-fieldIndex]
-	}
-	if fieldIndex <= 5 && idx > 5 {
-		line.V5 = fieldValues[5-fieldIndex]
-	}
-
-	_, err := a.engine.Context(ctx).Delete(&line)
-	return err
+	return a.transaction(ctx, func(tx *policyTx) error {
+		return tx.removeFilteredPolicy(ptype, fieldIndex, fieldValues...)
+	})
 }
 
 // LoadFilteredPolicy loads only policy rules that match the filter.
@@ -452,78 +755,562 @@ func (a *Adapter) LoadFilteredPolicy(model model.Model, filter interface{}) erro
 		return errors.New("invalid filter type")
 	}
 
-	lines := make([]*CasbinRule, 0, 64)
-	if err := a.filterQuery(a.engine.NewSession(), filterValue).Table(&CasbinRule{tableName: a.getFullTableName()}).Find(&lines); err != nil {
+	tenant, err := a.tenant(context.Background())
+	if err != nil {
+		return err
+	}
+	version, err := a.readVersion(context.Background(), tenant)
+	if err != nil {
 		return err
 	}
 
+	session := a.engine.NewSession()
+	defer session.Close()
+
+	lines := make([]*CasbinRule, 0, 64)
+	for _, table := range a.tablesOf(filterValue) {
+		if err := a.rules(a.filterQuery(session, filterValue), table, tenant).Find(&lines); err != nil {
+			return err
+		}
+	}
+
 	for _, line := range lines {
 		loadPolicyLine(line, model)
 	}
-	a.isFiltered = true
+	a.setLoaded(model, true, filterValue, tenant, version)
 	return nil
 }
 
 // IsFiltered returns true if the loaded policy has been filtered.
 func (a *Adapter) IsFiltered() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
 	return a.isFiltered
 }
 
-func (a *Adapter) filterQuery(session *xorm.Session, filter Filter) *xorm.Session {
-	filterValue := [7]struct {
+// setLoaded records the model, the filter, the tenant and the version of the policy loaded last.
+func (a *Adapter) setLoaded(model model.Model, isFiltered bool, filter Filter, tenant string, version int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.model = model
+	a.isFiltered = isFiltered
+	a.filter = filter
+	a.loadedTenant = tenant
+	a.loadedVersion = version
+}
+
+// checkLoaded returns ErrSharedAdapter if the policy has been loaded into another model than
+// model, the recorded policy being the one of another enforcer. a.mu must be held.
+func (a *Adapter) checkLoaded(model model.Model) error {
+	if a.model != nil && reflect.ValueOf(a.model).Pointer() != reflect.ValueOf(model).Pointer() {
+		return ErrSharedAdapter
+	}
+	return nil
+}
+
+// SaveFilteredPolicy saves the policy rules inside the scope of the filter used
+// by the last LoadFilteredPolicy call, leaving the other rules untouched.
+func (a *Adapter) SaveFilteredPolicy(model model.Model) error {
+	return a.SaveFilteredPolicyCtx(context.Background(), model)
+}
+
+// SaveFilteredPolicyCtx saves the policy rules inside the scope of the filter used
+// by the last LoadFilteredPolicy call, leaving the other rules untouched.
+func (a *Adapter) SaveFilteredPolicyCtx(ctx context.Context, model model.Model) error {
+	a.mu.RLock()
+	isFiltered, filter := a.isFiltered, a.filter
+	err := a.checkLoaded(model)
+	a.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	if !isFiltered {
+		return errors.New("no filtered policy has been loaded")
+	}
+
+	lines := make([]*CasbinRule, 0, 64)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				if filter.match(ptype, rule) {
+					lines = append(lines, a.genPolicyLine(ptype, rule))
+				}
+			}
+		}
+	}
+
+	return a.transaction(ctx, func(tx *policyTx) error {
+		if err := tx.deleteFiltered(filter); err != nil {
+			return err
+		}
+		return tx.insert(lines...)
+	})
+}
+
+func (f Filter) fields() [7]struct {
+	col string
+	val []string
+} {
+	return [7]struct {
 		col string
 		val []string
 	}{
-		{"ptype", filter.Ptype},
-		{"v0", filter.V0},
-		{"v1", filter.V1},
-		{"v2", filter.V2},
-		{"v3", filter.V3},
-		{"v4", filter.V4},
-		{"v5", filter.V5},
+		{"ptype", f.Ptype},
+		{"v0", f.V0},
+		{"v1", f.V1},
+		{"v2", f.V2},
+		{"v3", f.V3},
+		{"v4", f.V4},
+		{"v5", f.V5},
+	}
+}
+
+func (f Filter) isEmpty() bool {
+	for _, field := range f.fields() {
+		if len(field.val) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether the rule would be selected by the filter in the database.
+func (f Filter) match(ptype string, rule []string) bool {
+	for idx, field := range f.fields() {
+		if len(field.val) == 0 {
+			continue
+		}
+
+		value := ptype
+		if idx > 0 {
+			value = ""
+			if idx-1 < len(rule) {
+				value = rule[idx-1]
+			}
+		}
+
+		found := false
+		for _, v := range field.val {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
+	return true
+}
+
+func (a *Adapter) filterQuery(session *xorm.Session, filter Filter) *xorm.Session {
+	filterValue := filter.fields()
 
 	for idx := range filterValue {
+		col := a.columnExpr(idx)
 		switch len(filterValue[idx].val) {
 		case 0:
 			continue
 		case 1:
-			session.And(filterValue[idx].col+" = ?", filterValue[idx].val[0])
+			session.And(col+" = ?", filterValue[idx].val[0])
 		default:
-			session.In(filterValue[idx].col, filterValue[idx].val)
+			args := make([]interface{}, 0, len(filterValue[idx].val))
+			for _, v := range filterValue[idx].val {
+				args = append(args, v)
+			}
+			session.And(col+" IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")+")", args...)
 		}
 	}
 
 	return session
 }
 
-// UpdatePolicy update oldRule to newPolicy permanently
-func (a *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []string) error {
-	oRule := a.genPolicyLine(ptype, oldRule)
-	_, err := a.engine.Update(a.genPolicyLine(ptype, newPolicy), oRule)
-	return err
+// The operations of the policy changes.
+const (
+	ChangeAdd    = "add"
+	ChangeRemove = "remove"
+	ChangeUpdate = "update"
+	ChangeSave   = "save"
+)
+
+// policyChange is a change of a policy rule made in a transaction.
+// A save change replaces the whole policy and has no rules.
+type policyChange struct {
+	op      string
+	ptype   string
+	oldRule []string
+	newRule []string
+	// auditOnly marks the rules replaced by a save, which are only recorded in the audit log.
+	auditOnly bool
 }
 
-// UpdatePolicies updates some policy rules to storage, like db, redis.
-func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
-	session := a.engine.NewSession()
+// policyTx is a transaction on the policy table which keeps track of the changed rules.
+type policyTx struct {
+	*xorm.Session
+	ctx     context.Context
+	adapter *Adapter
+	// tenant is the tenant of the changed rules, with WithTenantColumn.
+	tenant  string
+	changes []*policyChange
+	// version is the version of the policy after the transaction, with WithOptimisticLocking.
+	version int64
+	saved   bool
+}
+
+// tracksChanges returns whether the changed rules must be known, which costs
+// an extra query before deleting or updating rules.
+func (a *Adapter) tracksChanges() bool {
+	return a.changeLog || a.audit || a.hasSubscribers()
+}
+
+// transaction runs fn in a database transaction, together with the bookkeeping of the changes.
+func (a *Adapter) transaction(ctx context.Context, fn func(tx *policyTx) error) error {
+	session := a.engine.NewSession().Context(ctx)
 	defer session.Close()
 
 	if err := session.Begin(); err != nil {
 		return err
 	}
 
+	tx, err := a.runTransaction(ctx, session, fn)
+	if err != nil {
+		_ = session.Rollback()
+		return err
+	}
+
+	if err := session.Commit(); err != nil {
+		return err
+	}
+	a.committed(tx)
+	return nil
+}
+
+// runTransaction runs fn together with the bookkeeping of the changes, in the transaction
+// of session. committed must be called once the transaction has been committed.
+func (a *Adapter) runTransaction(ctx context.Context, session *xorm.Session, fn func(tx *policyTx) error) (*policyTx, error) {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &policyTx{Session: session, ctx: ctx, adapter: a, tenant: tenant}
+	if a.versioned() {
+		// Incrementing the version first locks it until the end of the transaction.
+		version, err := a.nextVersion(session, tenant)
+		if err != nil {
+			return nil, err
+		}
+		tx.version = version
+	}
+
+	if err := fn(tx); err != nil {
+		return nil, err
+	}
+
+	if a.changeLog {
+		if err := a.appendChangeLog(session, tx.tenant, tx.changes); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.audit {
+		if err := a.appendAuditLog(ctx, session, tx.tenant, tx.changes); err != nil {
+			return nil, err
+		}
+	}
+
+	a.watcherMu.RLock()
+	watcher := a.watcher
+	a.watcherMu.RUnlock()
+	if watcher != nil {
+		if err := watcher.record(session); err != nil {
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// committed updates the state of the adapter after the commit of tx.
+func (a *Adapter) committed(tx *policyTx) {
+	// The loaded policy is still up to date if no other adapter changed it in the meantime.
+	if a.optimistic {
+		a.mu.Lock()
+		if (a.loadedTenant == "" || tx.tenant == a.loadedTenant) && (tx.saved || tx.version == a.loadedVersion+1) {
+			a.loadedTenant = tx.tenant
+			a.loadedVersion = tx.version
+		}
+		a.mu.Unlock()
+	}
+	a.publish(tx.tenant, tx.changes)
+}
+
+// insertLines inserts the rules into their policy tables, through the custom rule type if any.
+func (tx *policyTx) insertLines(lines []*CasbinRule) error {
+	for _, line := range lines {
+		if err := tx.adapter.checkValues(line); err != nil {
+			return err
+		}
+	}
+	tables, groups := groupByTable(lines)
+	for _, table := range tables {
+		if err := tx.insertTable(table, groups[table]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTable inserts the rules of the policy table named table.
+func (tx *policyTx) insertTable(table string, lines []*CasbinRule) error {
+	if tx.adapter.ruleType != nil {
+		beans := make([]interface{}, 0, len(lines))
+		for _, line := range lines {
+			bean, err := tx.adapter.newRuleBean(tx.ctx, line)
+			if err != nil {
+				return err
+			}
+			beans = append(beans, bean)
+		}
+		if tx.adapter.tenantColumn != "" {
+			// The expression applies to all the beans, and replaces a field of the same column.
+			tx.SetExpr(tx.adapter.tenantColumn, sql.NullString{String: tx.tenant, Valid: true})
+		}
+		_, err := tx.Insert(beans...)
+		return err
+	}
+
+	if tx.adapter.columns != nil || tx.adapter.tenantColumn != "" {
+		rows := make([]map[string]interface{}, 0, len(lines))
+		for _, line := range lines {
+			row, err := tx.adapter.ruleRow(line, false)
+			if err != nil {
+				return err
+			}
+			if tx.adapter.tenantColumn != "" {
+				row[tx.adapter.tenantColumn] = tx.tenant
+			}
+			rows = append(rows, row)
+		}
+		_, err := tx.Table(table).Insert(rows)
+		return err
+	}
+
+	var err error
+	if len(lines) == 1 {
+		_, err = tx.InsertOne(lines[0])
+	} else {
+		_, err = tx.Insert(&lines)
+	}
+	return err
+}
+
+// insert inserts the rules.
+func (tx *policyTx) insert(lines ...*CasbinRule) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := tx.insertLines(lines); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		tx.changes = append(tx.changes, &policyChange{op: ChangeAdd, ptype: line.Ptype, newRule: line.toPolicyRow().Rule})
+	}
+	return nil
+}
+
+// delete deletes the rules matching the non-empty fields of cond.
+func (tx *policyTx) delete(cond *CasbinRule) error {
+	table := tx.adapter.tableFor(cond.Ptype)
+	str, args := tx.adapter.ruleCond(cond)
+	if tx.adapter.tracksChanges() {
+		lines := make([]*CasbinRule, 0)
+		if err := tx.adapter.rules(tx.Session, table, tx.tenant).Where(str, args...).Find(&lines); err != nil {
+			return err
+		}
+		tx.removed(lines)
+	}
+
+	_, err := tx.adapter.scope(tx.Where(str, args...), tx.tenant).Delete(&CasbinRule{tableName: table})
+	return err
+}
+
+// deleteFiltered deletes the rules matching the filter.
+func (tx *policyTx) deleteFiltered(filter Filter) error {
+	for _, table := range tx.adapter.tablesOf(filter) {
+		if tx.adapter.tracksChanges() {
+			lines := make([]*CasbinRule, 0)
+			if err := tx.adapter.rules(tx.adapter.filterQuery(tx.Session, filter), table, tx.tenant).Find(&lines); err != nil {
+				return err
+			}
+			tx.removed(lines)
+		}
+
+		tx.adapter.scope(tx.adapter.filterQuery(tx.Session, filter), tx.tenant)
+		if filter.isEmpty() {
+			tx.Where("1 = 1")
+		}
+		if _, err := tx.Delete(&CasbinRule{tableName: table}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sets the non-empty fields of line on the rules matching the non-empty fields of cond.
+func (tx *policyTx) update(line *CasbinRule, cond *CasbinRule) error {
+	if err := tx.adapter.checkValues(line); err != nil {
+		return err
+	}
+	row, err := tx.adapter.ruleRow(line, true)
+	if err != nil {
+		return err
+	}
+	table := tx.adapter.tableFor(cond.Ptype)
+	str, args := tx.adapter.ruleCond(cond)
+
+	var lines []*CasbinRule
+	if tx.adapter.tracksChanges() {
+		if err = tx.adapter.rules(tx.Session, table, tx.tenant).Where(str, args...).Find(&lines); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.adapter.scope(tx.Table(table).Where(str, args...), tx.tenant).Update(row); err != nil {
+		return err
+	}
+
+	newValues := line.values()
+	for _, old := range lines {
+		values := old.values()
+		for i, v := range newValues {
+			if v != "" {
+				values[i] = v
+			}
+		}
+		updated := &CasbinRule{Ptype: values[0], V0: values[1], V1: values[2], V2: values[3], V3: values[4], V4: values[5], V5: values[6]}
+		tx.changes = append(tx.changes, &policyChange{
+			op:      ChangeUpdate,
+			ptype:   old.Ptype,
+			oldRule: old.toPolicyRow().Rule,
+			newRule: updated.toPolicyRow().Rule,
+		})
+	}
+	return nil
+}
+
+// save records that the whole policy has been replaced by lines. The removed and inserted
+// rules are recorded one by one for the audit log, the inserted ones also in history mode.
+func (tx *policyTx) save(removed []*CasbinRule, lines []*CasbinRule) {
+	tx.saved = true
+	tx.changes = append(tx.changes, &policyChange{op: ChangeSave})
+	for _, line := range removed {
+		tx.changes = append(tx.changes, &policyChange{op: ChangeRemove, ptype: line.Ptype, oldRule: line.toPolicyRow().Rule, auditOnly: true})
+	}
+	if tx.adapter.history || tx.adapter.audit {
+		for _, line := range lines {
+			tx.changes = append(tx.changes, &policyChange{op: ChangeAdd, ptype: line.Ptype, newRule: line.toPolicyRow().Rule, auditOnly: !tx.adapter.history})
+		}
+	}
+}
+
+func (tx *policyTx) removed(lines []*CasbinRule) {
+	for _, line := range lines {
+		tx.changes = append(tx.changes, &policyChange{op: ChangeRemove, ptype: line.Ptype, oldRule: line.toPolicyRow().Rule})
+	}
+}
+
+// addPolicies inserts the rules of ptype.
+func (tx *policyTx) addPolicies(ptype string, rules [][]string) error {
+	for _, rule := range rules {
+		if err := tx.insert(tx.adapter.genPolicyLine(ptype, rule)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePolicies deletes the rules of ptype.
+func (tx *policyTx) removePolicies(ptype string, rules [][]string) error {
+	for _, rule := range rules {
+		if err := tx.delete(tx.adapter.genPolicyLine(ptype, rule)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFilteredPolicy deletes the rules of ptype matching the field values from fieldIndex.
+func (tx *policyTx) removeFilteredPolicy(ptype string, fieldIndex int, fieldValues ...string) error {
+	line := CasbinRule{Ptype: ptype, tableName: tx.adapter.tableFor(ptype)}
+
+	idx := fieldIndex + len(fieldValues)
+	if fieldIndex <= 0 && idx > 0 {
+		line.V0 = fieldValues[0-fieldIndex]
+	}
+	if fieldIndex <= 1 && idx > 1 {
+		line.V1 = fieldValues[1-fieldIndex]
+	}
+	if fieldIndex <= 2 && idx > 2 {
+		line.V2 = fieldValues[2-fieldIndex]
+	}
+	if fieldIndex <= 3 && idx > 3 {
+		line.V3 = fieldValues[3-fieldIndex]
+	}
+	if fieldIndex <= 4 && idx > 4 {
+		line.V4 = fieldValues[4-fieldIndex]
+	}
+	if fieldIndex <= 5 && idx > 5 {
+		line.V5 = fieldValues[5-fieldIndex]
+	}
+
+	return tx.delete(&line)
+}
+
+// updatePolicies replaces each of oldRules of ptype by the rule of newRules at the same index.
+func (tx *policyTx) updatePolicies(ptype string, oldRules, newRules [][]string) error {
 	for i, oldRule := range oldRules {
-		nRule, oRule := a.genPolicyLine(ptype, newRules[i]), a.genPolicyLine(ptype, oldRule)
-		if _, err := session.Update(nRule, oRule); err != nil {
+		nRule, oRule := tx.adapter.genPolicyLine(ptype, newRules[i]), tx.adapter.genPolicyLine(ptype, oldRule)
+		if err := tx.update(nRule, oRule); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	return session.Commit()
+// UpdatePolicy update oldRule to newPolicy permanently
+func (a *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []string) error {
+	return a.UpdatePolicyCtx(context.Background(), sec, ptype, oldRule, newPolicy)
+}
+
+// UpdatePolicyCtx update oldRule to newPolicy permanently
+func (a *Adapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newPolicy []string) error {
+	return a.transaction(ctx, func(tx *policyTx) error {
+		return tx.updatePolicies(ptype, [][]string{oldRule}, [][]string{newPolicy})
+	})
+}
+
+// UpdatePolicies updates some policy rules to storage, like db, redis.
+func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return a.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx updates some policy rules to storage, like db, redis.
+func (a *Adapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	return a.transaction(ctx, func(tx *policyTx) error {
+		return tx.updatePolicies(ptype, oldRules, newRules)
+	})
 }
 
 func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	return a.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newPolicies, fieldIndex, fieldValues...)
+}
+
+func (a *Adapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
 	// UpdateFilteredPolicies deletes old rules and adds new rules.
 	line := &CasbinRule{}
 
@@ -552,24 +1339,29 @@ func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [
 	for _, newRule := range newPolicies {
 		newP = append(newP, *a.genPolicyLine(ptype, newRule))
 	}
-	tx := a.engine.NewSession().Table(&CasbinRule{tableName: a.getFullTableName()})
-	defer tx.Close()
-
-	if err := tx.Begin(); err != nil {
-		return nil, err
-	}
-
-	for i := range newP {
-		str, args := line.queryString()
-		if err := tx.Where(str, args...).Find(&oldP); err != nil {
-			return nil, tx.Rollback()
-		}
-		if _, err := tx.Where(str.(string), args...).Delete(&CasbinRule{tableName: a.getFullTableName()}); err != nil {
-			return nil, tx.Rollback()
-		}
-		if _, err := tx.Insert(&newP[i]); err != nil {
-			return nil, tx.Rollback()
+	table := a.tableFor(ptype)
+	err := a.transaction(ctx, func(tx *policyTx) error {
+		for i := range newP {
+			str, args := a.ruleCond(line)
+			lines := make([]*CasbinRule, 0)
+			if err := a.rules(tx.Session, table, tx.tenant).Where(str, args...).Find(&lines); err != nil {
+				return err
+			}
+			if _, err := a.scope(tx.Where(str, args...), tx.tenant).Delete(&CasbinRule{tableName: table}); err != nil {
+				return err
+			}
+			tx.removed(lines)
+			for _, l := range lines {
+				oldP = append(oldP, *l)
+			}
+			if err := tx.insert(&newP[i]); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// return deleted rulues
@@ -578,7 +1370,7 @@ func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [
 		oldPolicy := v.toStringPolicy()
 		oldPolicies = append(oldPolicies, oldPolicy)
 	}
-	return oldPolicies, tx.Commit()
+	return oldPolicies, nil
 }
 
 func (c *CasbinRule) toStringPolicy() []string {
@@ -606,35 +1398,3 @@ func (c *CasbinRule) toStringPolicy() []string {
 	}
 	return policy
 }
-
-func (c *CasbinRule) queryString() (interface{}, []interface{}) {
-	queryArgs := []interface{}{c.Ptype}
-
-	queryStr := "ptype = ?"
-	if c.V0 != "" {
-		queryStr += " and v0 = ?"
-		queryArgs = append(queryArgs, c.V0)
-	}
-	if c.V1 != "" {
-		queryStr += " and v1 = ?"
-		queryArgs = append(queryArgs, c.V1)
-	}
-	if c.V2 != "" {
-		queryStr += " and v2 = ?"
-		queryArgs = append(queryArgs, c.V2)
-	}
-	if c.V3 != "" {
-		queryStr += " and v3 = ?"
-		queryArgs = append(queryArgs, c.V3)
-	}
-	if c.V4 != "" {
-		queryStr += " and v4 = ?"
-		queryArgs = append(queryArgs, c.V4)
-	}
-	if c.V5 != "" {
-		queryStr += " and v5 = ?"
-		queryArgs = append(queryArgs, c.V5)
-	}
-
-	return queryStr, queryArgs
-}
@@ -15,14 +15,21 @@
 package xormadapter
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/util"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"xorm.io/xorm"
 )
 
 func testGetPolicy(t *testing.T, e *casbin.Enforcer, res [][]string) {
@@ -310,6 +317,55 @@ func testUpdateFilteredPolicies(t *testing.T, a *Adapter) {
 	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"bob", "data2", "read"}})
 }
 
+func testSaveFilteredPolicy(t *testing.T, a *Adapter) {
+	// Initialize some policy in DB.
+	initPolicy(t, a)
+	// Note: you don't need to look at the above code
+	// if you already have a working DB with policy inside.
+
+	// Now the DB has policy, so we can provide a normal use case.
+	// Create an adapter and an enforcer.
+	// NewEnforcer() will load the policy automatically.
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	// Now set the adapter
+	e.SetAdapter(a)
+
+	var err error
+	logErr := func(action string) {
+		if err != nil {
+			t.Fatalf("test action[%s] failed, err: %v", action, err)
+		}
+	}
+
+	// Load only the policies of data2_admin and edit them in memory.
+	err = e.LoadFilteredPolicy(Filter{Ptype: []string{"p"}, V0: []string{"data2_admin"}})
+	logErr("LoadFilteredPolicy")
+	_, err = e.RemovePolicy("data2_admin", "data2", "write")
+	logErr("RemovePolicy")
+	e.EnableAutoSave(false)
+	_, err = e.AddPolicy("data2_admin", "data3", "read")
+	logErr("AddPolicy")
+	// Rules outside of the filter are ignored.
+	_, err = e.AddPolicy("carol", "data3", "read")
+	logErr("AddPolicy2")
+
+	// SavePolicy is refused for a filtered policy, so save the filtered scope only.
+	err = a.SaveFilteredPolicy(e.GetModel())
+	logErr("SaveFilteredPolicy")
+
+	err = e.LoadPolicy()
+	logErr("LoadPolicy")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data3", "read"}})
+	if !e.HasGroupingPolicy("alice", "data2_admin") {
+		t.Error("grouping policy outside of the filter should be kept")
+	}
+
+	if err = a.SaveFilteredPolicy(e.GetModel()); err == nil {
+		t.Error("SaveFilteredPolicy should fail after loading the whole policy")
+	}
+}
+
 func testGetPolicyWithoutOrder(t *testing.T, e *casbin.Enforcer, res [][]string) {
 	myRes := e.GetPolicy()
 	log.Print("Policy: ", myRes)
@@ -366,6 +422,7 @@ func TestAdapters(t *testing.T) {
 	testRemovePolicies(t, a)
 	testUpdatePolicies(t, a)
 	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
 
 	a, _ = NewAdapter("postgres", "user=postgres password=postgres host=127.0.0.1 port=5432 sslmode=disable")
 	testSaveLoad(t, a)
@@ -375,6 +432,7 @@ func TestAdapters(t *testing.T) {
 	testRemovePolicies(t, a)
 	testUpdatePolicies(t, a)
 	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
 
 	a, _ = NewAdapterWithTableName("mysql", "root:@tcp(127.0.0.1:3306)/", "test", "abc")
 	testSaveLoad(t, a)
@@ -384,4 +442,148 @@ func TestAdapters(t *testing.T) {
 	testRemovePolicies(t, a)
 	testUpdatePolicies(t, a)
 	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
+}
+
+func newSQLiteAdapter(t *testing.T) *Adapter {
+	t.Helper()
+	a, err := NewAdapter("sqlite3", filepath.Join(t.TempDir(), "casbin.db"))
+	if err != nil {
+		t.Fatalf("failed to create sqlite adapter, err: %v", err)
+	}
+	return a
+}
+
+func TestSQLiteAdapter(t *testing.T) {
+	a := newSQLiteAdapter(t)
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+	testFilteredPolicy(t, a)
+	testAddPolicies(t, a)
+	testRemovePolicies(t, a)
+	testUpdatePolicies(t, a)
+	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
+}
+
+// TestSQLiteAdapterConcurrency shares an adapter between enforcers used concurrently,
+// it is meant to be run with the race detector.
+func TestSQLiteAdapterConcurrency(t *testing.T) {
+	// SQLite serializes the writers, which wait for each other instead of failing.
+	dataSourceName := "file:" + filepath.Join(t.TempDir(), "casbin.db") + "?_busy_timeout=10000&_txlock=immediate"
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			e, err := casbin.NewEnforcer("examples/rbac_model.conf", a.ForEnforcer())
+			if err != nil {
+				t.Errorf("failed to create enforcer, err: %v", err)
+				return
+			}
+			for j := 0; j < 10; j++ {
+				user := fmt.Sprintf("user%d-%d", i, j)
+				if _, err = e.AddPolicy(user, "data1", "read"); err != nil {
+					t.Errorf("AddPolicy failed, err: %v", err)
+				}
+				if _, err = e.RemovePolicy(user, "data1", "read"); err != nil {
+					t.Errorf("RemovePolicy failed, err: %v", err)
+				}
+				if err = e.LoadFilteredPolicy(Filter{V0: []string{"alice"}}); err != nil {
+					t.Errorf("LoadFilteredPolicy failed, err: %v", err)
+				}
+				_ = a.IsFiltered()
+				if err = e.LoadPolicy(); err != nil {
+					t.Errorf("LoadPolicy failed, err: %v", err)
+				}
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 5; j++ {
+			w, err := NewWatcher(a, time.Millisecond)
+			if err != nil {
+				t.Errorf("failed to create watcher, err: %v", err)
+				return
+			}
+			w.Close()
+		}
+	}()
+	wg.Wait()
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestSQLiteExistingTable(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	engine, err := xorm.NewEngine("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	_, err = engine.Exec(`CREATE TABLE permissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		policy_type VARCHAR(100) NOT NULL DEFAULT '',
+		sub VARCHAR(100) NOT NULL DEFAULT '',
+		obj VARCHAR(100) NOT NULL DEFAULT '',
+		act VARCHAR(100) NOT NULL DEFAULT '',
+		dom VARCHAR(100) NOT NULL DEFAULT '')`)
+	if err != nil {
+		t.Fatalf("failed to create the table, err: %v", err)
+	}
+
+	a, err := NewAdapterByEngineWithOptions(engine, WithExistingTable("permissions", "policy_type", "sub", "obj", "act", "dom"))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+	testFilteredPolicy(t, a)
+	testAddPolicies(t, a)
+	testRemovePolicies(t, a)
+	testUpdatePolicies(t, a)
+	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
+
+	// The table has been kept, with its own columns.
+	count, err := engine.Table("permissions").Where("id > 0 AND policy_type <> ''").Count()
+	if err != nil {
+		t.Fatalf("failed to count the rules, err: %v", err)
+	}
+	if total, _ := a.CountPolicies(context.Background(), Filter{}); count != total || count == 0 {
+		t.Errorf("%d rules found in the table, supposed to be %d", count, total)
+	}
+
+	ctx := context.Background()
+	if has, err := a.HasPolicy(ctx, "p", []string{"alice", "data1", "read"}); err != nil || !has {
+		t.Errorf("HasPolicy = %v, err: %v, supposed to be true", has, err)
+	}
+	values, err := a.ListDistinctValues(ctx, "p", 0, Filter{}, 0)
+	if err != nil {
+		t.Fatalf("ListDistinctValues failed, err: %v", err)
+	}
+	if !util.ArrayEquals(values, []string{"alice", "bob", "data2_admin"}) {
+		t.Errorf("ListDistinctValues = %v", values)
+	}
+	res, err := a.QueryPolicies(ctx, Filter{Ptype: []string{"p"}}, Page{Limit: 2, OrderBy: []string{"-v0"}})
+	if err != nil {
+		t.Fatalf("QueryPolicies failed, err: %v", err)
+	}
+	if len(res.Rows) != 2 || res.Rows[0].Rule[0] != "data2_admin" || res.NextCursor == "" {
+		t.Errorf("QueryPolicies = %+v", res)
+	}
+
+	if err = a.AddPolicy("p", "p", []string{"alice", "data1", "read", "domain1", "extra"}); err == nil {
+		t.Error("a rule with more values than columns should be rejected")
+	}
 }
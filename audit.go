@@ -0,0 +1,93 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// AuditRecord is a change of the policy stored in the audit table.
+// OldRule and NewRule are JSON arrays, empty when not applicable:
+// an "add" has no old rule, a "remove" has no new rule and a "save",
+// which replaces the whole policy, has neither but is followed by
+// the removal of the previous rules and the addition of the new ones.
+// Tenant is the tenant of the changed rules, with WithTenantColumn.
+type AuditRecord struct {
+	Id      int64     `xorm:"pk autoincr"`
+	Op      string    `xorm:"varchar(16) not null default ''"`
+	Ptype   string    `xorm:"varchar(100) not null default ''"`
+	OldRule string    `xorm:"text"`
+	NewRule string    `xorm:"text"`
+	Actor   string    `xorm:"varchar(255) not null default ''"`
+	Tenant  string    `xorm:"varchar(100) not null default ''"`
+	Created time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the audit table.
+func (r *AuditRecord) TableName() string {
+	return r.tableName
+}
+
+func (a *Adapter) auditTableName() string {
+	return a.ruleTableName() + "_audit"
+}
+
+func (a *Adapter) auditActor(ctx context.Context) string {
+	if a.auditActorKey == nil {
+		return ""
+	}
+	if actor := ctx.Value(a.auditActorKey); actor != nil {
+		return fmt.Sprint(actor)
+	}
+	return ""
+}
+
+func encodeAuditRule(rule []string) string {
+	if rule == nil {
+		return ""
+	}
+	data, _ := json.Marshal(rule)
+	return string(data)
+}
+
+func (a *Adapter) appendAuditLog(ctx context.Context, session *xorm.Session, tenant string, changes []*policyChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	actor := a.auditActor(ctx)
+	records := make([]*AuditRecord, 0, len(changes))
+	for _, change := range changes {
+		records = append(records, &AuditRecord{
+			Op:        change.op,
+			Ptype:     change.ptype,
+			OldRule:   encodeAuditRule(change.oldRule),
+			NewRule:   encodeAuditRule(change.newRule),
+			Actor:     actor,
+			Tenant:    tenant,
+			tableName: a.auditTableName(),
+		})
+	}
+
+	_, err := session.Insert(&records)
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+type actorKey struct{}
+
+func TestAuditLog(t *testing.T) {
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), WithAuditLog(actorKey{}))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+
+	var logErr = func(action string) {
+		if err != nil {
+			t.Fatalf("test action[%s] failed, err: %v", action, err)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), actorKey{}, "admin")
+	err = a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"})
+	logErr("AddPolicyCtx")
+	err = a.UpdatePolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}, []string{"carol", "data3", "write"})
+	logErr("UpdatePolicyCtx")
+	err = a.RemovePolicy("p", "p", []string{"carol", "data3", "write"})
+	logErr("RemovePolicy")
+
+	testAuditRecords(t, a, 0, []AuditRecord{
+		{Op: "save"},
+		{Op: "add", Ptype: "p", NewRule: `["alice","data1","read"]`},
+		{Op: "add", Ptype: "p", NewRule: `["bob","data2","write"]`},
+		{Op: "add", Ptype: "p", NewRule: `["data2_admin","data2","read"]`},
+		{Op: "add", Ptype: "p", NewRule: `["data2_admin","data2","write"]`},
+		{Op: "add", Ptype: "g", NewRule: `["alice","data2_admin"]`},
+		{Op: "add", Ptype: "p", NewRule: `["carol","data3","read"]`, Actor: "admin"},
+		{Op: "update", Ptype: "p", OldRule: `["carol","data3","read"]`, NewRule: `["carol","data3","write"]`, Actor: "admin"},
+		{Op: "remove", Ptype: "p", OldRule: `["carol","data3","write"]`},
+	})
+
+	// The rules replaced by a save are recorded, not only the save.
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+	_, err = e.RemovePolicy("bob", "data2", "write")
+	logErr("RemovePolicy")
+	err = a.SavePolicy(e.GetModel())
+	logErr("SavePolicy")
+	testAuditRecords(t, a, 9, []AuditRecord{
+		{Op: "save"},
+		{Op: "remove", Ptype: "p", OldRule: `["alice","data1","read"]`},
+		{Op: "remove", Ptype: "p", OldRule: `["bob","data2","write"]`},
+		{Op: "remove", Ptype: "p", OldRule: `["data2_admin","data2","read"]`},
+		{Op: "remove", Ptype: "p", OldRule: `["data2_admin","data2","write"]`},
+		{Op: "remove", Ptype: "g", OldRule: `["alice","data2_admin"]`},
+		{Op: "add", Ptype: "p", NewRule: `["alice","data1","read"]`},
+		{Op: "add", Ptype: "p", NewRule: `["data2_admin","data2","read"]`},
+		{Op: "add", Ptype: "p", NewRule: `["data2_admin","data2","write"]`},
+		{Op: "add", Ptype: "g", NewRule: `["alice","data2_admin"]`},
+	})
+
+	err = e.LoadFilteredPolicy(Filter{V0: []string{"data2_admin"}})
+	logErr("LoadFilteredPolicy")
+	_, err = e.RemovePolicy("data2_admin", "data2", "write")
+	logErr("RemovePolicy")
+	err = a.SaveFilteredPolicy(e.GetModel())
+	logErr("SaveFilteredPolicy")
+	testAuditRecords(t, a, 19, []AuditRecord{
+		{Op: "remove", Ptype: "p", OldRule: `["data2_admin","data2","read"]`},
+		{Op: "remove", Ptype: "p", OldRule: `["data2_admin","data2","write"]`},
+		{Op: "add", Ptype: "p", NewRule: `["data2_admin","data2","read"]`},
+	})
+}
+
+// testAuditRecords checks the audit records of a, from the one at the offset.
+func testAuditRecords(t *testing.T, a *Adapter, offset int, want []AuditRecord) {
+	t.Helper()
+
+	records := make([]*AuditRecord, 0)
+	if err := a.engine.Table(&AuditRecord{tableName: a.auditTableName()}).Asc("id").Find(&records); err != nil {
+		t.Fatalf("failed to find the audit records, err: %v", err)
+	}
+	if len(records) != offset+len(want) {
+		t.Fatalf("%d audit records, supposed to be %d", len(records), offset+len(want))
+	}
+	for i, r := range records[offset:] {
+		w := want[i]
+		if r.Op != w.Op || r.Ptype != w.Ptype || r.OldRule != w.OldRule || r.NewRule != w.NewRule || r.Actor != w.Actor {
+			t.Errorf("audit record %d: %+v, supposed to be %+v", offset+i, *r, w)
+		}
+		if r.Created.IsZero() {
+			t.Errorf("audit record %d has no timestamp", offset+i)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"xorm.io/xorm"
+)
+
+// changeHistory marks the start of the history in the change log, it is followed by the
+// rules of the policy at that time.
+const changeHistory = "history"
+
+// ChangeLogEntry is a change of the policy stored in the change-log table.
+// Updates are stored as a removal followed by an addition.
+type ChangeLogEntry struct {
+	Seq   int64  `xorm:"pk"`
+	Op    string `xorm:"varchar(16) not null default ''"`
+	Ptype string `xorm:"varchar(100) not null default ''"`
+	V0    string `xorm:"varchar(100) not null default ''"`
+	V1    string `xorm:"varchar(100) not null default ''"`
+	V2    string `xorm:"varchar(100) not null default ''"`
+	V3    string `xorm:"varchar(100) not null default ''"`
+	V4    string `xorm:"varchar(100) not null default ''"`
+	V5    string `xorm:"varchar(100) not null default ''"`
+	// Tenant is the tenant of the change, if the rules are scoped by tenant.
+	Tenant string `xorm:"varchar(100) not null default ''"`
+	// Instance identifies the adapter which made the change.
+	Instance string    `xorm:"varchar(64) not null default ''"`
+	Created  time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the change-log table.
+func (e *ChangeLogEntry) TableName() string {
+	return e.tableName
+}
+
+// policySeq is a row of the sequence table, holding the last number of a counter.
+// Writers increment it in their transaction, so the row lock orders them and
+// the numbers become visible in order.
+type policySeq struct {
+	Id  int64 `xorm:"pk"`
+	Seq int64 `xorm:"not null default 0"`
+
+	tableName string `xorm:"-"`
+}
+
+// The rows of the sequence table.
+const (
+	// seqChangeLog numbers the entries of the change log.
+	seqChangeLog = 1
+	// seqVersion is the version of the policy, incremented by every write, see tenantSeq
+	// for the rules scoped by tenant.
+	seqVersion = 2
+	// seqDispatch numbers the messages of the dispatcher.
+	seqDispatch = 3
+	// seqWatcher numbers the records of the watcher.
+	seqWatcher = 4
+)
+
+// TableName returns the name of the sequence table.
+func (s *policySeq) TableName() string {
+	return s.tableName
+}
+
+// tenantSeq is a row of the tenant sequence table, holding the version of the policy of a
+// tenant, which replaces seqVersion when the rules are scoped by tenant.
+type tenantSeq struct {
+	Tenant string `xorm:"varchar(100) pk"`
+	Seq    int64  `xorm:"not null default 0"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the tenant sequence table.
+func (s *tenantSeq) TableName() string {
+	return s.tableName
+}
+
+func (a *Adapter) changeLogTableName() string {
+	return a.ruleTableName() + "_changelog"
+}
+
+func (a *Adapter) seqTableName() string {
+	return a.ruleTableName() + "_seq"
+}
+
+func (a *Adapter) tenantSeqTableName() string {
+	return a.ruleTableName() + "_tenant_seq"
+}
+
+// versioned reports whether the writes increment the version of the policy: with
+// WithOptimisticLocking, and with the change log if the rules are scoped by tenant,
+// for PolicyVersion.
+func (a *Adapter) versioned() bool {
+	return a.optimistic || a.changeLog && a.tenantColumn != ""
+}
+
+func (a *Adapter) createChangeLogTables(session *xorm.Session) error {
+	if err := a.createSeqTable(session); err != nil {
+		return err
+	}
+	if err := a.sync(session, &ChangeLogEntry{tableName: a.changeLogTableName()}); err != nil {
+		return err
+	}
+
+	if a.history {
+		return a.startHistory(session)
+	}
+	return nil
+}
+
+// createSeqTable creates the sequence table and its rows, if not existed.
+func (a *Adapter) createSeqTable(session *xorm.Session) error {
+	seq := &policySeq{tableName: a.seqTableName()}
+	if err := a.sync(session, seq); err != nil {
+		return err
+	}
+
+	for _, id := range []int64{seqChangeLog, seqVersion, seqDispatch, seqWatcher} {
+		exist, err := session.Table(seq).ID(id).Exist()
+		if err != nil {
+			return err
+		}
+		if !exist {
+			if _, err = session.InsertOne(&policySeq{Id: id, tableName: a.seqTableName()}); err != nil {
+				// Another instance may have inserted the row in the meantime.
+				if exist, _ = session.Table(seq).ID(id).Exist(); !exist {
+					return err
+				}
+			}
+		}
+	}
+
+	if a.versioned() && a.tenantColumn != "" {
+		return a.sync(session, &tenantSeq{tableName: a.tenantSeqTableName()})
+	}
+	return nil
+}
+
+// lockSeq locks the sequence row of the change log until the end of the transaction.
+func (a *Adapter) lockSeq(session *xorm.Session) error {
+	_, err := a.nextSeq(session, seqChangeLog, 0)
+	return err
+}
+
+// nextSeq reserves n numbers of the counter id and returns the last one.
+func (a *Adapter) nextSeq(session *xorm.Session, id int64, n int64) (int64, error) {
+	seq := &policySeq{tableName: a.seqTableName()}
+	if _, err := session.Table(seq).ID(id).Incr("seq", n).NoAutoCondition().Update(seq); err != nil {
+		return 0, err
+	}
+	return a.currentSeq(session, id)
+}
+
+func (a *Adapter) currentSeq(session *xorm.Session, id int64) (int64, error) {
+	seq := &policySeq{tableName: a.seqTableName()}
+	has, err := session.Table(seq).ID(id).Get(seq)
+	if err != nil {
+		return 0, err
+	}
+	if !has {
+		return 0, fmt.Errorf("the row %d of the sequence table is missing", id)
+	}
+	return seq.Seq, nil
+}
+
+// nextVersion increments the version of the policy of tenant and returns it.
+// The row of a tenant is created by its first write, so that the concurrent
+// first writes of a new tenant may fail on the duplicate row.
+func (a *Adapter) nextVersion(session *xorm.Session, tenant string) (int64, error) {
+	if a.tenantColumn == "" {
+		return a.nextSeq(session, seqVersion, 1)
+	}
+
+	seq := &tenantSeq{tableName: a.tenantSeqTableName()}
+	affected, err := session.Table(seq).Where("tenant = ?", tenant).Incr("seq", 1).NoAutoCondition().Update(seq)
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		if _, err = session.InsertOne(&tenantSeq{Tenant: tenant, Seq: 1, tableName: a.tenantSeqTableName()}); err != nil {
+			return 0, err
+		}
+	}
+	return a.currentVersion(session, tenant)
+}
+
+// currentVersion returns the version of the policy of tenant.
+func (a *Adapter) currentVersion(session *xorm.Session, tenant string) (int64, error) {
+	if a.tenantColumn == "" {
+		return a.currentSeq(session, seqVersion)
+	}
+
+	seq := &tenantSeq{tableName: a.tenantSeqTableName()}
+	if _, err := session.Table(seq).Where("tenant = ?", tenant).NoAutoCondition().Get(seq); err != nil {
+		return 0, err
+	}
+	return seq.Seq, nil
+}
+
+func (a *Adapter) appendChangeLog(session *xorm.Session, tenant string, changes []*policyChange) error {
+	return a.insertChangeLogEntries(session, a.changeLogEntries(tenant, changes))
+}
+
+func (a *Adapter) changeLogEntries(tenant string, changes []*policyChange) []*ChangeLogEntry {
+	entries := make([]*ChangeLogEntry, 0, len(changes))
+	for _, change := range changes {
+		if change.auditOnly {
+			continue
+		}
+		switch change.op {
+		case ChangeAdd:
+			entries = append(entries, a.newChangeLogEntry(ChangeAdd, tenant, change.ptype, change.newRule))
+		case ChangeRemove:
+			entries = append(entries, a.newChangeLogEntry(ChangeRemove, tenant, change.ptype, change.oldRule))
+		case ChangeUpdate:
+			entries = append(entries, a.newChangeLogEntry(ChangeRemove, tenant, change.ptype, change.oldRule))
+			entries = append(entries, a.newChangeLogEntry(ChangeAdd, tenant, change.ptype, change.newRule))
+		case ChangeSave:
+			entries = append(entries, a.newChangeLogEntry(ChangeSave, tenant, "", nil))
+		}
+	}
+	return entries
+}
+
+func (a *Adapter) insertChangeLogEntries(session *xorm.Session, entries []*ChangeLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	last, err := a.nextSeq(session, seqChangeLog, int64(len(entries)))
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		entry.Seq = last - int64(len(entries)-1-i)
+	}
+
+	_, err = session.Insert(&entries)
+	return err
+}
+
+func (a *Adapter) newChangeLogEntry(op string, tenant string, ptype string, rule []string) *ChangeLogEntry {
+	line := a.genPolicyLine(ptype, rule)
+	return &ChangeLogEntry{
+		Op:        op,
+		Ptype:     line.Ptype,
+		V0:        line.V0,
+		V1:        line.V1,
+		V2:        line.V2,
+		V3:        line.V3,
+		V4:        line.V4,
+		V5:        line.V5,
+		Tenant:    tenant,
+		Instance:  a.instanceID(),
+		tableName: a.changeLogTableName(),
+	}
+}
+
+func (e *ChangeLogEntry) rule() []string {
+	line := &CasbinRule{Ptype: e.Ptype, V0: e.V0, V1: e.V1, V2: e.V2, V3: e.V3, V4: e.V4, V5: e.V5}
+	return line.toPolicyRow().Rule
+}
+
+// LoadPolicyDelta applies the changes made since the sequence number sinceSeq to the model,
+// and returns the sequence number to pass to the next call. The whole policy is reloaded
+// instead when sinceSeq is 0, when the policy has been saved as a whole or history mode has
+// been started since then, or when the entries since then have been pruned from the change log.
+// The role links of the enforcer need to be rebuilt afterwards if grouping rules have changed.
+func (a *Adapter) LoadPolicyDelta(ctx context.Context, model model.Model, sinceSeq int64) (int64, error) {
+	if !a.changeLog {
+		return 0, errors.New("the change log is not enabled")
+	}
+
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The entry of sinceSeq is read whatever its tenant, to tell whether it has been pruned.
+	entries := make([]*ChangeLogEntry, 0, 64)
+	if sinceSeq > 0 {
+		query := a.engine.Context(ctx).Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).Where("seq >= ?", sinceSeq)
+		if tenant != "" {
+			query.And("(tenant = ? OR op = ? OR seq = ?)", tenant, changeHistory, sinceSeq)
+		}
+		if err = query.Asc("seq").Find(&entries); err != nil {
+			return 0, err
+		}
+	}
+
+	// The entry of sinceSeq itself has already been applied. The start of the history
+	// is followed by the rules of the policy, which aren't changes.
+	full := sinceSeq <= 0 || len(entries) == 0 || entries[0].Seq != sinceSeq
+	for i := 1; !full && i < len(entries); i++ {
+		full = entries[i].Op == ChangeSave || entries[i].Op == changeHistory
+	}
+
+	if full {
+		session := a.engine.NewSession().Context(ctx)
+		seq, err := a.currentSeq(session, seqChangeLog)
+		session.Close()
+		if err != nil {
+			return 0, err
+		}
+		model.ClearPolicy()
+		if err = a.LoadPolicyCtx(ctx, model); err != nil {
+			return 0, err
+		}
+		return seq, nil
+	}
+
+	if err := applyChangeLogEntries(entries[1:], model); err != nil {
+		return 0, err
+	}
+	return entries[len(entries)-1].Seq, nil
+}
+
+// applyChangeLogEntries applies the additions and removals of rules to the model.
+func applyChangeLogEntries(entries []*ChangeLogEntry, model model.Model) error {
+	for _, entry := range entries {
+		if entry.Ptype == "" {
+			continue
+		}
+		sec := entry.Ptype[:1]
+		rule := entry.rule()
+		switch entry.Op {
+		case ChangeAdd:
+			if err := persist.LoadPolicyArray(append([]string{entry.Ptype}, rule...), model); err != nil {
+				return err
+			}
+		case ChangeRemove:
+			if _, ok := model[sec][entry.Ptype]; ok {
+				model.RemovePolicy(sec, entry.Ptype, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// scopeChangeLog restricts session to the entries of the change log of tenant and to the
+// starts of the history, which are followed by the rules of all the tenants, if tenant is set.
+func (a *Adapter) scopeChangeLog(session *xorm.Session, tenant string) *xorm.Session {
+	if tenant == "" {
+		return session
+	}
+	return session.And("(tenant = ? OR op = ?)", tenant, changeHistory)
+}
+
+// PruneChangeLog removes the entries of the change log with a sequence number lower than beforeSeq,
+// whatever their tenant. Callers of LoadPolicyDelta with a pruned sequence number reload the whole policy.
+// In history mode, pruning the start of the history makes LoadPolicyAt unavailable.
+func (a *Adapter) PruneChangeLog(ctx context.Context, beforeSeq int64) error {
+	if !a.changeLog {
+		return errors.New("the change log is not enabled")
+	}
+
+	_, err := a.engine.Context(ctx).Where("seq < ?", beforeSeq).Delete(&ChangeLogEntry{tableName: a.changeLogTableName()})
+	return err
+}
+
+// startHistory records the current policy as the start of the history,
+// unless history mode has already been started for the policy table.
+func (a *Adapter) startHistory(session *xorm.Session) error {
+	// Lock the sequence first, so that the changes committed after reading
+	// the policy are logged after the start of the history.
+	if err := a.lockSeq(session); err != nil {
+		return err
+	}
+	return a.recordHistoryStart(session)
+}
+
+func (a *Adapter) recordHistoryStart(session *xorm.Session) error {
+	exist, err := session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).Where("op = ?", changeHistory).Exist()
+	if err != nil || exist {
+		return err
+	}
+
+	entries := make([]*ChangeLogEntry, 0, 64)
+	entries = append(entries, a.newChangeLogEntry(changeHistory, "", "", nil))
+	for _, table := range a.ruleTables() {
+		tenants := []string{""}
+		if a.tenantColumn != "" {
+			tenants = tenants[:0]
+			if err = session.Table(table).Distinct(a.tenantColumn).Find(&tenants); err != nil {
+				return err
+			}
+		}
+		for _, tenant := range tenants {
+			lines := make([]*CasbinRule, 0, 64)
+			if err = a.rules(session, table, tenant).Find(&lines); err != nil {
+				return err
+			}
+			for _, line := range lines {
+				entries = append(entries, a.newChangeLogEntry(ChangeAdd, tenant, line.Ptype, line.toPolicyRow().Rule))
+			}
+		}
+	}
+	return a.insertChangeLogEntries(session, entries)
+}
+
+// LoadPolicyAt loads the policy as it was at the given time into the model,
+// from the change log recorded in history mode. The change log records the time
+// of the changes with a precision of one second.
+func (a *Adapter) LoadPolicyAt(ctx context.Context, model model.Model, at time.Time) error {
+	if !a.history {
+		return errors.New("history mode is not enabled")
+	}
+
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return err
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	// The last change made at that time, the timestamps are stored like xorm does.
+	var last []*ChangeLogEntry
+	err = a.scopeChangeLog(session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).
+		Where("created <= ?", at.In(a.engine.DatabaseTZ).Format("2006-01-02 15:04:05")), tenant).Desc("seq").Limit(1).Find(&last)
+	if err != nil {
+		return err
+	}
+	if len(last) == 0 {
+		return fmt.Errorf("no history of the policy at %v", at)
+	}
+
+	// The policy is replayed from the last time it has been replaced as a whole,
+	// which can't be earlier than the start of the history.
+	var base []*ChangeLogEntry
+	err = a.scopeChangeLog(session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).
+		Where("seq <= ?", last[0].Seq).In("op", ChangeSave, changeHistory), tenant).Desc("seq").Limit(1).Find(&base)
+	if err != nil {
+		return err
+	}
+	var start []*ChangeLogEntry
+	err = session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).
+		Where("op = ?", changeHistory).Asc("seq").Limit(1).Find(&start)
+	if err != nil {
+		return err
+	}
+	if len(base) == 0 || len(start) == 0 || base[0].Seq < start[0].Seq {
+		return fmt.Errorf("no history of the policy at %v", at)
+	}
+
+	entries := make([]*ChangeLogEntry, 0, 64)
+	err = a.scopeChangeLog(session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).
+		Where("seq > ? AND seq <= ?", base[0].Seq, last[0].Seq), tenant).Asc("seq").Find(&entries)
+	if err != nil {
+		return err
+	}
+
+	model.ClearPolicy()
+	return applyChangeLogEntries(entries, model)
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestLoadPolicyDelta(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithChangeLog())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	var logErr = func(action string) {
+		if err != nil {
+			t.Fatalf("test action[%s] failed, err: %v", action, err)
+		}
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+	seq, err := a.LoadPolicyDelta(ctx, e.GetModel(), 0)
+	logErr("LoadPolicyDelta")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if seq == 0 {
+		t.Fatal("the sequence number should be set after saving the policy")
+	}
+
+	err = a.AddPolicies("p", "p", [][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}})
+	logErr("AddPolicies")
+	err = a.RemovePolicy("p", "p", []string{"bob", "data2", "write"})
+	logErr("RemovePolicy")
+	err = a.UpdatePolicy("p", "p", []string{"carol", "data3", "write"}, []string{"carol", "data4", "write"})
+	logErr("UpdatePolicy")
+	err = a.RemoveFilteredPolicy("p", "p", 0, "data2_admin")
+	logErr("RemoveFilteredPolicy")
+
+	// Only the changes are applied, a rule added to the model since the last load is kept.
+	e.GetModel().AddPolicy("p", "p", []string{"local", "data1", "read"})
+	next, err := a.LoadPolicyDelta(ctx, e.GetModel(), seq)
+	logErr("LoadPolicyDelta2")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"carol", "data4", "write"}, {"local", "data1", "read"}})
+	if next <= seq {
+		t.Errorf("the sequence number %d should be greater than %d", next, seq)
+	}
+
+	same, err := a.LoadPolicyDelta(ctx, e.GetModel(), next)
+	logErr("LoadPolicyDelta3")
+	if same != next {
+		t.Errorf("the sequence number %d should be unchanged without changes, supposed to be %d", same, next)
+	}
+
+	// Pruned entries force a full reload.
+	err = a.AddPolicy("p", "p", []string{"dave", "data1", "read"})
+	logErr("AddPolicy")
+	err = a.PruneChangeLog(ctx, next+1)
+	logErr("PruneChangeLog")
+	_, err = a.LoadPolicyDelta(ctx, e.GetModel(), next)
+	logErr("LoadPolicyDelta4")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"carol", "data4", "write"}, {"dave", "data1", "read"}})
+
+	// The start of the history forces a full reload, its rules aren't added again.
+	seq, err = a.LoadPolicyDelta(ctx, e.GetModel(), 0)
+	logErr("LoadPolicyDelta5")
+	_, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithHistory())
+	logErr("NewAdapterWithOptions")
+	e.GetModel().AddPolicy("p", "p", []string{"local", "data1", "read"})
+	_, err = a.LoadPolicyDelta(ctx, e.GetModel(), seq)
+	logErr("LoadPolicyDelta6")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"carol", "data4", "write"}, {"dave", "data1", "read"}})
+}
+
+func TestLoadPolicyAt(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	var logErr = func(action string) {
+		if err != nil {
+			t.Fatalf("test action[%s] failed, err: %v", action, err)
+		}
+	}
+
+	// The timestamps of the change log have a precision of one second,
+	// so leave a second without changes around each point in time.
+	mark := func() time.Time {
+		time.Sleep(1100 * time.Millisecond)
+		at := time.Now()
+		time.Sleep(1100 * time.Millisecond)
+		return at
+	}
+
+	// Enabling history mode on an existing table starts the history with its current rules.
+	a, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithHistory())
+	logErr("NewAdapterWithOptions")
+	start := mark()
+
+	err = a.AddPolicy("p", "p", []string{"carol", "data3", "read"})
+	logErr("AddPolicy")
+	err = a.RemovePolicy("p", "p", []string{"bob", "data2", "write"})
+	logErr("RemovePolicy")
+	added := mark()
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+	e.GetModel().AddPolicy("p", "p", []string{"dave", "data1", "read"})
+	err = a.SavePolicy(e.GetModel())
+	logErr("SavePolicy")
+	saved := mark()
+
+	err = a.AddPolicy("p", "p", []string{"erin", "data1", "read"})
+	logErr("AddPolicy2")
+
+	testCases := []struct {
+		at   time.Time
+		want [][]string
+	}{
+		{start, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}},
+		{added, [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}},
+		{saved, [][]string{{"dave", "data1", "read"}}},
+		{time.Now(), [][]string{{"dave", "data1", "read"}, {"erin", "data1", "read"}}},
+	}
+	for _, tc := range testCases {
+		err = a.LoadPolicyAt(ctx, e.GetModel(), tc.at)
+		logErr("LoadPolicyAt")
+		testGetPolicyWithoutOrder(t, e, tc.want)
+	}
+
+	if err = a.LoadPolicyAt(ctx, e.GetModel(), start.Add(-time.Hour)); err == nil {
+		t.Error("LoadPolicyAt should fail before the start of the history")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command casbin-ddl prints the statements creating the tables used by the xorm adapter,
+// to be applied out of band, for example:
+//
+//	casbin-ddl -db postgres -table rule -prefix app_ -changelog
+//	casbin-ddl -db mysql -column-type v1=300,prefix=191 -index composite -composite ptype,v0 -route g=casbin_role
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	xormadapter "github.com/casbin/xorm-adapter/v3"
+)
+
+// listFlag collects the values of a flag given several times.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// cut splits s around the first "=", like strings.Cut.
+func cut(s string) (string, string, bool) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) < 2 {
+		return s, "", false
+	}
+	return parts[0], parts[1], true
+}
+
+var indexStrategies = map[string]xormadapter.IndexStrategy{
+	"default":    xormadapter.IndexDefault,
+	"per-column": xormadapter.IndexPerColumn,
+	"composite":  xormadapter.IndexComposite,
+	"none":       xormadapter.IndexNone,
+}
+
+// parseColumnType parses a column type given as field=spec, the spec being a comma-separated
+// list of a size, "text", "size=N" and "prefix=N", such as "v1=300,prefix=191" or "v2=text".
+func parseColumnType(value string) (string, xormadapter.ColumnType, error) {
+	var columnType xormadapter.ColumnType
+	field, spec, ok := cut(value)
+	if !ok || field == "" || spec == "" {
+		return "", columnType, fmt.Errorf("invalid column type %q, supposed to be field=spec", value)
+	}
+	for _, part := range strings.Split(spec, ",") {
+		if part == "text" {
+			columnType.Text = true
+			continue
+		}
+		name, number, ok := cut(part)
+		if !ok {
+			name, number = "size", part
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return "", columnType, fmt.Errorf("invalid column type %q: %q isn't a number", value, number)
+		}
+		switch name {
+		case "size":
+			columnType.Size = n
+		case "prefix":
+			columnType.IndexPrefix = n
+		default:
+			return "", columnType, fmt.Errorf("invalid column type %q: unknown %q", value, name)
+		}
+	}
+	return field, columnType, nil
+}
+
+func options() ([]xormadapter.Option, string, int, error) {
+	var columnTypes, composites, routes listFlag
+	dbType := flag.String("db", "mysql", "the database type: mysql, postgres, sqlite3 or mssql")
+	tableName := flag.String("table", "casbin_rule", "the name of the policy table")
+	tablePrefix := flag.String("prefix", "", "the prefix of the policy table")
+	columns := flag.Int("columns", 6, "the number of value columns of the policy table, from 1 to 6")
+	changeLog := flag.Bool("changelog", false, "generate the tables of WithChangeLog")
+	audit := flag.Bool("audit", false, "generate the table of WithAuditLog")
+	optimistic := flag.Bool("optimistic", false, "generate the table of WithOptimisticLocking")
+	watcher := flag.Bool("watcher", false, "generate the tables of NewWatcher")
+	dispatcher := flag.Bool("dispatcher", false, "generate the tables of NewDispatcher")
+	snapshots := flag.Bool("snapshots", false, "generate the tables of the snapshots")
+	schema := flag.String("schema", "", "the schema of the tables on Postgres")
+	charset := flag.String("charset", "", "the charset of the tables on MySQL")
+	collation := flag.String("collation", "", "the collation of the tables on MySQL")
+	storeEngine := flag.String("engine", "", "the storage engine of the tables on MySQL")
+	flag.Var(&columnTypes, "column-type", "the type of the column of a field, such as v1=300,prefix=191 or v2=text, can be repeated")
+	index := flag.String("index", "default", "the index strategy of the policy tables: default, per-column, composite or none")
+	flag.Var(&composites, "composite", "the columns of a composite index, such as ptype,v0, can be repeated")
+	flag.Var(&routes, "route", "the table of a ptype or a section, such as g=casbin_role, can be repeated")
+	tenantColumn := flag.String("tenant", "", "the tenant column of the policy tables")
+	flag.Parse()
+
+	opts := []xormadapter.Option{
+		xormadapter.WithTableName(*tableName, *tablePrefix),
+		xormadapter.WithSchema(*schema),
+		xormadapter.WithMySQLTableOptions(*charset, *collation, *storeEngine),
+	}
+	if *changeLog {
+		opts = append(opts, xormadapter.WithChangeLog())
+	}
+	if *audit {
+		opts = append(opts, xormadapter.WithAuditLog(nil))
+	}
+	if *optimistic {
+		opts = append(opts, xormadapter.WithOptimisticLocking())
+	}
+
+	var features []xormadapter.Feature
+	if *watcher {
+		features = append(features, xormadapter.FeatureWatcher)
+	}
+	if *dispatcher {
+		features = append(features, xormadapter.FeatureDispatcher)
+	}
+	if *snapshots {
+		features = append(features, xormadapter.FeatureSnapshots)
+	}
+	opts = append(opts, xormadapter.WithFeatures(features...))
+
+	for _, value := range columnTypes {
+		field, columnType, err := parseColumnType(value)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		opts = append(opts, xormadapter.WithColumnType(field, columnType))
+	}
+
+	strategy, ok := indexStrategies[*index]
+	if !ok {
+		return nil, "", 0, fmt.Errorf("unknown index strategy %q", *index)
+	}
+	indexes := make([][]string, 0, len(composites))
+	for _, composite := range composites {
+		indexes = append(indexes, strings.Split(composite, ","))
+	}
+	opts = append(opts, xormadapter.WithIndexStrategy(strategy, indexes...))
+
+	if len(routes) > 0 {
+		tables := make(map[string]string, len(routes))
+		for _, route := range routes {
+			ptype, table, ok := cut(route)
+			if !ok {
+				return nil, "", 0, fmt.Errorf("invalid route %q, supposed to be ptype=table", route)
+			}
+			tables[ptype] = table
+		}
+		opts = append(opts, xormadapter.WithTableRouting(tables))
+	}
+	if *tenantColumn != "" {
+		opts = append(opts, xormadapter.WithTenantColumn(*tenantColumn, ""))
+	}
+	return opts, *dbType, *columns, nil
+}
+
+func main() {
+	opts, dbType, columns, err := options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	stmts, err := xormadapter.GenerateDDL(dbType, columns, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(xormadapter.FormatDDL(stmts))
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"fmt"
+	"strings"
+
+	"xorm.io/xorm"
+)
+
+// columnName returns the column of the field at idx of the rules, ptype being the field 0,
+// or an empty string if the policy table has no such column.
+func (a *Adapter) columnName(idx int) string {
+	if a.columns == nil {
+		return ruleColumns[idx]
+	}
+	if idx < len(a.columns) {
+		return a.columns[idx]
+	}
+	return ""
+}
+
+// columnExpr returns the SQL expression of the field at idx of the rules,
+// which is an empty string for the fields without a column.
+func (a *Adapter) columnExpr(idx int) string {
+	name := a.columnName(idx)
+	if name == "" {
+		return "''"
+	}
+	if a.columns == nil {
+		return name
+	}
+	return a.engine.Quote(name)
+}
+
+// rules prepares session to read the rules of tenant from the policy table named table.
+func (a *Adapter) rules(session *xorm.Session, table string, tenant string) *xorm.Session {
+	a.scope(session.Table(table), tenant)
+	if a.columns == nil {
+		return session
+	}
+
+	cols := make([]string, 0, len(ruleColumns))
+	for idx, name := range ruleColumns {
+		if a.columnName(idx) != "" {
+			cols = append(cols, a.columnExpr(idx)+" AS "+name)
+		}
+	}
+	return session.Select(strings.Join(cols, ", "))
+}
+
+// ruleCond returns the condition matching the non-empty fields of line,
+// the same way as xorm does with a bean.
+func (a *Adapter) ruleCond(line *CasbinRule) (string, []interface{}) {
+	conds := make([]string, 0, len(ruleColumns))
+	args := make([]interface{}, 0, len(ruleColumns))
+	for idx, v := range line.values() {
+		if v != "" {
+			conds = append(conds, a.columnExpr(idx)+" = ?")
+			args = append(args, v)
+		}
+	}
+	if len(conds) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// exactCond returns the condition matching exactly line, comparing the empty fields as well,
+// or false if no rule of the policy table can match it.
+func (a *Adapter) exactCond(line *CasbinRule) (string, []interface{}, bool) {
+	conds := make([]string, 0, len(ruleColumns))
+	args := make([]interface{}, 0, len(ruleColumns))
+	for idx, v := range line.values() {
+		if a.columnName(idx) == "" {
+			if v != "" {
+				return "", nil, false
+			}
+			continue
+		}
+		conds = append(conds, a.columnExpr(idx)+" = ?")
+		args = append(args, v)
+	}
+	return strings.Join(conds, " AND "), args, true
+}
+
+// ruleRow returns the columns of line to insert or update, only the non-empty ones if nonEmpty.
+func (a *Adapter) ruleRow(line *CasbinRule, nonEmpty bool) (map[string]interface{}, error) {
+	row := make(map[string]interface{}, len(ruleColumns))
+	for idx, v := range line.values() {
+		if nonEmpty && v == "" {
+			continue
+		}
+		name := a.columnName(idx)
+		if name == "" {
+			if v != "" {
+				return nil, fmt.Errorf("the policy table has no column for the field %s of %v", ruleColumns[idx], line.toStringPolicy())
+			}
+			continue
+		}
+		row[name] = v
+	}
+	return row, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"xorm.io/xorm/caches"
+	"xorm.io/xorm/dialects"
+	"xorm.io/xorm/names"
+	"xorm.io/xorm/schemas"
+	"xorm.io/xorm/tags"
+)
+
+// GenerateDDL returns the CREATE TABLE and CREATE INDEX statements of the tables the adapter
+// expects with opts on a database of dbType, one of "mysql", "postgres", "sqlite3" and "mssql",
+// as created by the adapter itself, so that they can be reviewed and applied out of band
+// before using the adapter with WithoutSchemaSync.
+//
+// The policy tables have the ptype column and columns value columns, v0 to v5 with 6.
+// A policy table with fewer value columns must be used with WithExistingTable, listing them.
+// The tables of the watcher, the dispatcher and the snapshots are generated when declared
+// with WithFeatures.
+func GenerateDDL(dbType string, columns int, opts ...Option) ([]string, error) {
+	if columns < 1 || columns > len(ruleColumns)-1 {
+		return nil, fmt.Errorf("the number of value columns must be between 1 and %d", len(ruleColumns)-1)
+	}
+	switch schemas.DBType(dbType) {
+	case schemas.MYSQL, schemas.POSTGRES, schemas.SQLITE, schemas.MSSQL:
+	default:
+		return nil, fmt.Errorf("unsupported database type %q", dbType)
+	}
+
+	a := &Adapter{}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	uri := &dialects.URI{DBType: schemas.DBType(dbType)}
+	if uri.DBType == schemas.POSTGRES {
+		uri.Schema = a.schema
+	}
+	dialect := dialects.QueryDialect(uri.DBType)
+	if err := dialect.Init(uri); err != nil {
+		return nil, err
+	}
+	parser := tags.NewParser("xorm", dialect, names.SnakeMapper{}, names.SnakeMapper{}, caches.NewManager())
+	if a.existingTable && a.ruleType != nil {
+		return nil, fmt.Errorf("a custom rule type can't be used with an existing table")
+	}
+	if err := a.checkSchemaOptions(); err != nil {
+		return nil, err
+	}
+
+	bean, err := a.ruleBean()
+	if err != nil {
+		return nil, err
+	}
+	table, err := parser.Parse(reflect.Indirect(reflect.ValueOf(bean)))
+	if err != nil {
+		return nil, err
+	}
+	table, prefixes, err := a.buildTable(table, columns, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var stmts []string
+	for _, tableName := range a.ruleTables() {
+		tableStmts, err := a.createTableStmts(dialect, table, tableName, prefixes)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, tableStmts...)
+	}
+	for _, feature := range a.featureTables(schemas.DBType(dbType)) {
+		table, err := parser.Parse(reflect.Indirect(reflect.ValueOf(feature.bean)))
+		if err != nil {
+			return nil, err
+		}
+		table, prefixes, err := a.buildTable(table, len(ruleColumns)-1, false)
+		if err != nil {
+			return nil, err
+		}
+		tableStmts, err := a.createTableStmts(dialect, table, feature.name, prefixes)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, tableStmts...)
+	}
+	return stmts, nil
+}
+
+// FormatDDL joins the statements returned by GenerateDDL into a script.
+func FormatDDL(stmts []string) string {
+	var b strings.Builder
+	for _, stmt := range stmts {
+		b.WriteString(stmt)
+		b.WriteString(";\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xorm.io/xorm"
+)
+
+func TestGenerateDDL(t *testing.T) {
+	opts := []Option{WithChangeLog(), WithAuditLog(nil), WithoutSchemaSync(),
+		WithFeatures(FeatureWatcher, FeatureDispatcher, FeatureSnapshots)}
+	stmts, err := GenerateDDL("sqlite3", 6, opts...)
+	if err != nil {
+		t.Fatalf("GenerateDDL failed, err: %v", err)
+	}
+
+	// The tables created from the statements are the ones expected by the adapter.
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "casbin.db"))
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	for _, stmt := range stmts {
+		if _, err = engine.Exec(stmt); err != nil {
+			t.Fatalf("failed to execute %q, err: %v", stmt, err)
+		}
+	}
+	a, err := NewAdapterByEngineWithOptions(engine, opts...)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = a.VerifySchema(context.Background()); err != nil {
+		t.Fatalf("VerifySchema failed, err: %v", err)
+	}
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+
+	// Fewer value columns, with mapped names.
+	stmts, err = GenerateDDL("mysql", 3, WithExistingTable("permissions", "policy_type", "sub", "obj", "act"))
+	if err != nil {
+		t.Fatalf("GenerateDDL failed, err: %v", err)
+	}
+	expected := "CREATE TABLE IF NOT EXISTS `permissions` (`policy_type` VARCHAR(100) DEFAULT '' NOT NULL, `sub` VARCHAR(100) DEFAULT '' NOT NULL, `obj` VARCHAR(100) DEFAULT '' NOT NULL, `act` VARCHAR(100) DEFAULT '' NOT NULL);\n" +
+		"CREATE INDEX `IDX_permissions_EXISTS` ON `permissions` (`policy_type`,`sub`,`obj`,`act`);\n"
+	if ddl := FormatDDL(stmts); ddl != expected {
+		t.Errorf("GenerateDDL = %s", ddl)
+	}
+
+	for _, dbType := range []string{"postgres", "mssql"} {
+		stmts, err = GenerateDDL(dbType, 6, WithTableName("rule", "app_"))
+		if err != nil {
+			t.Fatalf("GenerateDDL failed for %s, err: %v", dbType, err)
+		}
+		if len(stmts) == 0 || !strings.Contains(stmts[0], "app_rule") {
+			t.Errorf("GenerateDDL = %v for %s", stmts, dbType)
+		}
+	}
+
+	if _, err = GenerateDDL("oracle", 6); err == nil {
+		t.Error("an unsupported database should be rejected")
+	}
+	if _, err = GenerateDDL("mysql", 7); err == nil {
+		t.Error("more than 6 value columns should be rejected")
+	}
+}
+
+func TestSchemaAndTableOptions(t *testing.T) {
+	stmts, err := GenerateDDL("postgres", 6, WithSchema("authz"), WithChangeLog())
+	if err != nil {
+		t.Fatalf("GenerateDDL failed, err: %v", err)
+	}
+	ddl := FormatDDL(stmts)
+	for _, expected := range []string{
+		`CREATE TABLE IF NOT EXISTS "authz"."casbin_rule" (`,
+		`CREATE INDEX "IDX_casbin_rule_EXISTS" ON "authz"."casbin_rule" (`,
+		`CREATE TABLE IF NOT EXISTS "authz"."casbin_rule_changelog" (`,
+	} {
+		if !strings.Contains(ddl, expected) {
+			t.Errorf("%q not found in %s", expected, ddl)
+		}
+	}
+
+	stmts, err = GenerateDDL("mysql", 6, WithMySQLTableOptions("utf8mb4", "utf8mb4_bin", "InnoDB"))
+	if err != nil {
+		t.Fatalf("GenerateDDL failed, err: %v", err)
+	}
+	if !strings.HasSuffix(stmts[0], ") ENGINE=InnoDB DEFAULT CHARSET utf8mb4 COLLATE utf8mb4_bin") {
+		t.Errorf("the table options are missing from %s", stmts[0])
+	}
+
+	// The options of other databases are ignored.
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"),
+		WithSchema("authz"), WithMySQLTableOptions("utf8mb4", "utf8mb4_bin", "InnoDB"))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	testSaveLoad(t, a)
+
+	// The schema of an engine owned by the caller isn't changed.
+	engine, err := xorm.NewEngine("postgres", "user=postgres password=postgres host=127.0.0.1 port=5432 sslmode=disable dbname=casbin")
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	defer engine.Close()
+	if _, err = NewAdapterByEngineWithOptions(engine, WithSchema("authz")); err == nil {
+		t.Error("WithSchema should be rejected with an engine using another schema")
+	}
+	if engine.Dialect().URI().Schema == "authz" {
+		t.Error("the schema of the engine has been changed")
+	}
+}
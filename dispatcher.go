@@ -0,0 +1,336 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/persist"
+	"xorm.io/xorm"
+)
+
+// dispatchRetention is the number of messages kept in the dispatcher table.
+const dispatchRetention = 1000
+
+// The operations of the dispatcher messages, besides ChangeAdd, ChangeRemove and ChangeUpdate.
+const (
+	dispatchRemoveFiltered = "remove_filtered"
+	dispatchUpdateFiltered = "update_filtered"
+	dispatchClear          = "clear"
+)
+
+// dispatchMessage is a change of the policy stored in the dispatcher table.
+type dispatchMessage struct {
+	Seq      int64  `xorm:"pk"`
+	Instance string `xorm:"varchar(64) not null default ''"`
+	Op       string `xorm:"varchar(32) not null default ''"`
+	Sec      string `xorm:"varchar(16) not null default ''"`
+	Ptype    string `xorm:"varchar(100) not null default ''"`
+	// Payload is the JSON encoding of a dispatchPayload.
+	Payload string    `xorm:"text"`
+	Created time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the dispatcher table.
+func (m *dispatchMessage) TableName() string {
+	return m.tableName
+}
+
+// dispatchPayload holds the arguments of a dispatched operation.
+type dispatchPayload struct {
+	Rules       [][]string `json:"rules,omitempty"`
+	NewRules    [][]string `json:"new_rules,omitempty"`
+	FieldIndex  int        `json:"field_index,omitempty"`
+	FieldValues []string   `json:"field_values,omitempty"`
+}
+
+// Dispatcher is a persist.Dispatcher using a companion table of the policy table as transport.
+// The changes are written to the policy table together with a message in the dispatcher
+// table, in a single transaction. Every node, including the one making the change, polls
+// the messages and applies them in order to its enforcer, so the enforcer is updated
+// asynchronously: its policy changes at the next poll, not when the call returns.
+type Dispatcher struct {
+	adapter   *Adapter
+	enforcer  casbin.IDistributedEnforcer
+	tableName string
+	interval  time.Duration
+
+	lastSeq int64
+	wake    chan struct{}
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ persist.Dispatcher = &Dispatcher{}
+
+// NewDispatcher creates a dispatcher for the policy table of the adapter, sets it on
+// the enforcer and starts applying the messages of the other nodes, polled at the given
+// interval. The dispatcher table is named after the policy table with a "_dispatch" suffix
+// and is created if it doesn't exist. The enforcer is expected to have loaded the policy.
+func NewDispatcher(a *Adapter, e casbin.IDistributedEnforcer, interval time.Duration) (*Dispatcher, error) {
+	if interval <= 0 {
+		return nil, errors.New("invalid parameter: interval")
+	}
+	// The messages would be applied to the enforcers of the other tenants.
+	if a.tenantColumn != "" {
+		return nil, errTenantUnsupported("a dispatcher")
+	}
+
+	d := &Dispatcher{
+		adapter:   a,
+		enforcer:  e,
+		tableName: a.dispatchTableName(),
+		interval:  interval,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err := a.changeSchema(func(session *xorm.Session) error {
+		if err := a.createSeqTable(session); err != nil {
+			return err
+		}
+		return a.sync(session, d.bean())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*dispatchMessage
+	if err := a.engine.Table(d.bean()).Desc("seq").Limit(1).Find(&messages); err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 {
+		d.lastSeq = messages[0].Seq
+	}
+
+	e.SetDispatcher(d)
+	go d.run()
+
+	return d, nil
+}
+
+func (a *Adapter) dispatchTableName() string {
+	return a.ruleTableName() + "_dispatch"
+}
+
+func (d *Dispatcher) bean() *dispatchMessage {
+	return &dispatchMessage{tableName: d.tableName}
+}
+
+// send runs write in a transaction of the adapter and adds the message to it.
+func (d *Dispatcher) send(op string, sec string, ptype string, payload dispatchPayload, write func(tx *policyTx) error) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	err = d.adapter.transaction(context.Background(), func(tx *policyTx) error {
+		if write != nil {
+			if err := write(tx); err != nil {
+				return err
+			}
+		}
+
+		seq, err := d.adapter.nextSeq(tx.Session, seqDispatch, 1)
+		if err != nil {
+			return err
+		}
+		message := &dispatchMessage{
+			Seq:       seq,
+			Instance:  d.adapter.instanceID(),
+			Op:        op,
+			Sec:       sec,
+			Ptype:     ptype,
+			Payload:   string(data),
+			tableName: d.tableName,
+		}
+		if _, err = tx.InsertOne(message); err != nil {
+			return err
+		}
+		return d.prune(tx.Session)
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// prune deletes the messages beyond the retention.
+func (d *Dispatcher) prune(session *xorm.Session) error {
+	var messages []*dispatchMessage
+	if err := session.Table(d.bean()).Cols("seq").Desc("seq").Limit(1, dispatchRetention).Find(&messages); err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	_, err := session.Where("seq <= ?", messages[0].Seq).Delete(d.bean())
+	return err
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		if err := d.poll(); err != nil {
+			log.Printf("poll xorm dispatcher table failed, err: %v", err)
+		}
+	}
+}
+
+// poll applies the messages stored since the last poll to the enforcer, in order.
+func (d *Dispatcher) poll() error {
+	var messages []*dispatchMessage
+	if err := d.adapter.engine.Table(d.bean()).Where("seq >= ?", d.lastSeq).Asc("seq").Find(&messages); err != nil {
+		return err
+	}
+
+	// If the last applied message has been pruned, the messages since then are lost
+	// and the whole policy is reloaded instead.
+	if d.lastSeq > 0 && (len(messages) == 0 || messages[0].Seq != d.lastSeq) {
+		if err := d.enforcer.LoadPolicy(); err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			d.lastSeq = messages[len(messages)-1].Seq
+		}
+		return nil
+	}
+
+	for _, message := range messages {
+		if message.Seq <= d.lastSeq {
+			continue
+		}
+		if err := d.apply(message); err != nil {
+			log.Printf("apply xorm dispatcher message %d failed, err: %v", message.Seq, err)
+		}
+		d.lastSeq = message.Seq
+	}
+	return nil
+}
+
+// apply applies a message to the enforcer, without persisting it again.
+func (d *Dispatcher) apply(message *dispatchMessage) error {
+	var payload dispatchPayload
+	if err := json.Unmarshal([]byte(message.Payload), &payload); err != nil {
+		return err
+	}
+
+	var err error
+	switch message.Op {
+	case ChangeAdd:
+		_, err = d.enforcer.AddPoliciesSelf(nil, message.Sec, message.Ptype, payload.Rules)
+	case ChangeRemove:
+		_, err = d.enforcer.RemovePoliciesSelf(nil, message.Sec, message.Ptype, payload.Rules)
+	case dispatchRemoveFiltered:
+		_, err = d.enforcer.RemoveFilteredPolicySelf(nil, message.Sec, message.Ptype, payload.FieldIndex, payload.FieldValues...)
+	case ChangeUpdate:
+		_, err = d.enforcer.UpdatePoliciesSelf(nil, message.Sec, message.Ptype, payload.Rules, payload.NewRules)
+	case dispatchUpdateFiltered:
+		_, err = d.enforcer.RemovePoliciesSelf(nil, message.Sec, message.Ptype, payload.Rules)
+		if err == nil {
+			_, err = d.enforcer.AddPoliciesSelf(nil, message.Sec, message.Ptype, payload.NewRules)
+		}
+	case dispatchClear:
+		err = d.enforcer.ClearPolicySelf(nil)
+	default:
+		err = fmt.Errorf("unknown operation %q", message.Op)
+	}
+	return err
+}
+
+// AddPolicies adds the rules to the storage and to the enforcers of all nodes.
+func (d *Dispatcher) AddPolicies(sec string, ptype string, rules [][]string) error {
+	return d.send(ChangeAdd, sec, ptype, dispatchPayload{Rules: rules}, func(tx *policyTx) error {
+		return tx.addPolicies(ptype, rules)
+	})
+}
+
+// RemovePolicies removes the rules from the storage and from the enforcers of all nodes.
+func (d *Dispatcher) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	return d.send(ChangeRemove, sec, ptype, dispatchPayload{Rules: rules}, func(tx *policyTx) error {
+		return tx.removePolicies(ptype, rules)
+	})
+}
+
+// RemoveFilteredPolicy removes the rules matching the filter from the storage
+// and from the enforcers of all nodes.
+func (d *Dispatcher) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	payload := dispatchPayload{FieldIndex: fieldIndex, FieldValues: fieldValues}
+	return d.send(dispatchRemoveFiltered, sec, ptype, payload, func(tx *policyTx) error {
+		return tx.removeFilteredPolicy(ptype, fieldIndex, fieldValues...)
+	})
+}
+
+// ClearPolicy clears the policy of the enforcers of all nodes, the storage is left untouched.
+func (d *Dispatcher) ClearPolicy() error {
+	return d.send(dispatchClear, "", "", dispatchPayload{}, nil)
+}
+
+// UpdatePolicy updates the rule in the storage and in the enforcers of all nodes.
+func (d *Dispatcher) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return d.UpdatePolicies(sec, ptype, [][]string{oldRule}, [][]string{newRule})
+}
+
+// UpdatePolicies updates the rules in the storage and in the enforcers of all nodes.
+func (d *Dispatcher) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	if len(oldRules) != len(newRules) {
+		return errors.New("the number of old and new rules must be the same")
+	}
+	payload := dispatchPayload{Rules: oldRules, NewRules: newRules}
+	return d.send(ChangeUpdate, sec, ptype, payload, func(tx *policyTx) error {
+		return tx.updatePolicies(ptype, oldRules, newRules)
+	})
+}
+
+// UpdateFilteredPolicies replaces oldRules by newRules in the enforcers of all nodes.
+// The enforcer has already updated the storage through the adapter.
+func (d *Dispatcher) UpdateFilteredPolicies(sec string, ptype string, oldRules [][]string, newRules [][]string) error {
+	return d.send(dispatchUpdateFiltered, sec, ptype, dispatchPayload{Rules: oldRules, NewRules: newRules}, nil)
+}
+
+// Close stops applying the messages to the enforcer.
+func (d *Dispatcher) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func newDispatchedEnforcer(t *testing.T, a *Adapter) *casbin.DistributedEnforcer {
+	t.Helper()
+	e, err := casbin.NewDistributedEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatalf("failed to create enforcer, err: %v", err)
+	}
+	d, err := NewDispatcher(a, e, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create dispatcher, err: %v", err)
+	}
+	t.Cleanup(d.Close)
+	return e
+}
+
+// waitPolicy waits for the policy of the enforcer to become res.
+func waitPolicy(t *testing.T, e *casbin.DistributedEnforcer, res [][]string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if arrayEqualsWithoutOrder(e.GetPolicy(), res) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Policy: %v, supposed to be %v", e.GetPolicy(), res)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a1, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a2, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a1)
+
+	e1 := newDispatchedEnforcer(t, a1)
+	e2 := newDispatchedEnforcer(t, a2)
+
+	if _, err = e1.AddPolicies([][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}}); err != nil {
+		t.Fatalf("AddPolicies failed, err: %v", err)
+	}
+	if _, err = e2.RemovePolicy("bob", "data2", "write"); err != nil {
+		t.Fatalf("RemovePolicy failed, err: %v", err)
+	}
+	if _, err = e1.UpdatePolicy([]string{"carol", "data3", "write"}, []string{"carol", "data4", "write"}); err != nil {
+		t.Fatalf("UpdatePolicy failed, err: %v", err)
+	}
+	if _, err = e2.RemoveFilteredPolicy(0, "data2_admin"); err != nil {
+		t.Fatalf("RemoveFilteredPolicy failed, err: %v", err)
+	}
+
+	res := [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"carol", "data4", "write"}}
+	waitPolicy(t, e1, res)
+	waitPolicy(t, e2, res)
+
+	// The changes have been persisted once.
+	e3, _ := casbin.NewEnforcer("examples/rbac_model.conf", a1)
+	testGetPolicyWithoutOrder(t, e3, res)
+}
@@ -6,5 +6,6 @@ require (
 	github.com/casbin/casbin/v2 v2.77.2
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.16
 	xorm.io/xorm v1.3.2
 )
@@ -0,0 +1,172 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"xorm.io/xorm/schemas"
+)
+
+// IndexStrategy selects the indexes of the policy table, see WithIndexStrategy.
+type IndexStrategy int
+
+const (
+	// IndexDefault is the index declared by CasbinRule, spanning all the fields of the rules.
+	IndexDefault IndexStrategy = iota
+	// IndexPerColumn is an index on each field of the rules.
+	IndexPerColumn
+	// IndexComposite is a composite index for each filter shape, (ptype, v0) and (ptype, v1) by default.
+	IndexComposite
+	// IndexNone leaves the policy table without index.
+	IndexNone
+)
+
+// defaultCompositeIndexes are the filter shapes of IndexComposite by default.
+var defaultCompositeIndexes = [][]string{{"ptype", "v0"}, {"ptype", "v1"}}
+
+// ruleIndexes returns the indexes of the policy table with the index strategy,
+// false for IndexDefault, whose index is declared by the struct tags.
+func (a *Adapter) ruleIndexes() (map[string]*schemas.Index, bool) {
+	indexes := make(map[string]*schemas.Index)
+	add := func(fields ...string) {
+		index := schemas.NewIndex(strings.Join(fields, "_"), schemas.IndexType)
+		index.IsRegular = true
+		index.AddColumn(fields...)
+		indexes[index.Name] = index
+	}
+
+	switch a.indexStrategy {
+	case IndexPerColumn:
+		for _, field := range ruleColumns {
+			add(field)
+		}
+	case IndexComposite:
+		shapes := a.compositeIndexes
+		if len(shapes) == 0 {
+			shapes = defaultCompositeIndexes
+		}
+		for _, fields := range shapes {
+			add(fields...)
+		}
+	case IndexNone:
+	default:
+		return nil, false
+	}
+	return indexes, true
+}
+
+// checkIndexes checks that the composite indexes are made of fields of the rules.
+func (a *Adapter) checkIndexes() error {
+	for _, fields := range a.compositeIndexes {
+		if len(fields) == 0 {
+			return fmt.Errorf("a composite index has no field")
+		}
+		for _, field := range fields {
+			if a.fieldIndex(field) < 0 {
+				return fmt.Errorf("the composite index %v has the unknown field %q, supposed to be one of %v", fields, field, ruleColumns)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldIndex returns the index of field in the rules, ptype being 0, or -1 if unknown.
+func (a *Adapter) fieldIndex(field string) int {
+	for idx, name := range ruleColumns {
+		if name == field {
+			return idx
+		}
+	}
+	return -1
+}
+
+// IndexMigration returns a migration changing the indexes of the policy table to the ones of
+// the index strategy of the adapter, dropping the other indexes created by the adapter and
+// creating the missing ones. The unique indexes and the indexes named otherwise are kept.
+func IndexMigration(version int64) Migration {
+	return Migration{
+		Version:     version,
+		Description: "change the indexes of the policy table",
+		Up: func(ctx context.Context, m *Migrator) error {
+			a := m.adapter
+			if err := a.checkSchemaOptions(); err != nil {
+				return err
+			}
+			bean, err := a.ruleBean()
+			if err != nil {
+				return err
+			}
+			info, err := a.engine.TableInfo(bean)
+			if err != nil {
+				return err
+			}
+			columns := len(ruleColumns) - 1
+			if a.columns != nil && len(a.columns) < len(ruleColumns) {
+				columns = len(a.columns) - 1
+			}
+			table, prefixes, err := a.buildTable(info, columns, true)
+			if err != nil {
+				return err
+			}
+
+			dialect := a.engine.Dialect()
+			existing, err := dialect.GetIndexes(queryer(m.session), ctx, m.table)
+			if err != nil {
+				return err
+			}
+
+			kept := make(map[string]bool)
+			for _, name := range sortedIndexNames(existing) {
+				index := existing[name]
+				if !index.IsRegular || index.Type != schemas.IndexType {
+					continue
+				}
+				wanted := false
+				for key, expected := range table.Indexes {
+					if !kept[key] && index.Equal(expected) {
+						kept[key], wanted = true, true
+						break
+					}
+				}
+				if !wanted {
+					if err = m.Exec(dialect.DropIndexSQL(m.TableName(), index)); err != nil {
+						return err
+					}
+				}
+			}
+			for _, name := range sortedIndexNames(table.Indexes) {
+				if !kept[name] {
+					if err = m.Exec(a.createIndexSQL(dialect, m.TableName(), table.Indexes[name], prefixes)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func sortedIndexNames(indexes map[string]*schemas.Index) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func sqliteIndexes(t *testing.T, a *Adapter) []string {
+	var names []string
+	err := a.engine.SQL("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL ORDER BY name", a.ruleTableName()).Find(&names)
+	if err != nil {
+		t.Fatalf("failed to read the indexes, err: %v", err)
+	}
+	return names
+}
+
+func TestIndexStrategy(t *testing.T) {
+	ctx := context.Background()
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	composite := WithIndexStrategy(IndexComposite)
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, composite)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	expected := []string{"IDX_casbin_rule_ptype_v0", "IDX_casbin_rule_ptype_v1"}
+	if names := sqliteIndexes(t, a); !reflect.DeepEqual(names, expected) {
+		t.Errorf("the indexes are %v, supposed to be %v", names, expected)
+	}
+	testSaveLoad(t, a)
+
+	// The indexes are kept when the table is synced again.
+	if a, err = NewAdapterWithOptions("sqlite3", dataSourceName, composite); err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if names := sqliteIndexes(t, a); !reflect.DeepEqual(names, expected) {
+		t.Errorf("the indexes are %v after a new sync, supposed to be %v", names, expected)
+	}
+
+	// The indexes of an existing table are changed by the migration.
+	dataSourceName = filepath.Join(t.TempDir(), "casbin.db")
+	if _, err = NewAdapter("sqlite3", dataSourceName); err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithIndexStrategy(IndexComposite, []string{"ptype", "v0", "v1"}))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if names := sqliteIndexes(t, a); !reflect.DeepEqual(names, []string{"IDX_casbin_rule_EXISTS"}) {
+		t.Errorf("the indexes of the existing table are %v", names)
+	}
+	results, err := a.MigrateDryRun(ctx, IndexMigration(1))
+	if err != nil || len(results) != 1 || len(results[0].Statements) != 2 {
+		t.Fatalf("MigrateDryRun = %+v, err: %v", results, err)
+	}
+	if _, err = a.Migrate(ctx, IndexMigration(1)); err != nil {
+		t.Fatalf("Migrate failed, err: %v", err)
+	}
+	if names := sqliteIndexes(t, a); !reflect.DeepEqual(names, []string{"IDX_casbin_rule_ptype_v0_v1"}) {
+		t.Errorf("the indexes are %v after the migration", names)
+	}
+	testSaveLoad(t, a)
+
+	stmts, err := GenerateDDL("mysql", 6, WithIndexStrategy(IndexPerColumn))
+	if err != nil || len(stmts) != 8 {
+		t.Errorf("GenerateDDL = %v, err: %v", stmts, err)
+	}
+	stmts, err = GenerateDDL("mysql", 6, WithIndexStrategy(IndexNone))
+	if err != nil || len(stmts) != 1 {
+		t.Errorf("GenerateDDL = %v, err: %v", stmts, err)
+	}
+
+	if _, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithIndexStrategy(IndexComposite, []string{"ptype", "v9"})); err == nil {
+		t.Error("a composite index with an unknown field should be rejected")
+	}
+}
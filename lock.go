@@ -0,0 +1,217 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/dialects"
+	"xorm.io/xorm/schemas"
+)
+
+const (
+	// defaultLockTimeout is how long the adapter waits for the lock by default.
+	defaultLockTimeout = 30 * time.Second
+	// lockRetryInterval is how often the lock is tried again, when the database can't wait for it.
+	lockRetryInterval = 50 * time.Millisecond
+	// lockStaleAfter is the age after which a row of the lock table is considered to have been
+	// left by a crashed process.
+	lockStaleAfter = 10 * time.Minute
+)
+
+// ErrLockTimeout is returned when the lock of the policy table couldn't be taken in time.
+var ErrLockTimeout = errors.New("timeout waiting for the lock of the policy table")
+
+// policyLock is a lock held on the policy table, stored in the lock table of the
+// databases without named locks.
+type policyLock struct {
+	Name    string    `xorm:"varchar(255) pk"`
+	Owner   string    `xorm:"varchar(64) not null default ''"`
+	Created time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the lock table.
+func (l *policyLock) TableName() string {
+	return l.tableName
+}
+
+func (a *Adapter) lockName() string {
+	// The policy tables of different schemas have different locks.
+	name := "casbin:" + dialects.TableNameWithSchema(a.engine.Dialect(), a.ruleTableName())
+	// The lock names of MySQL are limited to 64 characters.
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// withLock runs fn holding a database-level lock on the policy table, so that
+// destructive operations of several processes don't interleave: an advisory lock
+// on Postgres, GET_LOCK on MySQL and a row of a lock table on the other databases.
+// fn runs in a transaction of session, on the connection holding the locks of Postgres
+// and MySQL, so that an engine with a single connection can be used.
+func (a *Adapter) withLock(ctx context.Context, fn func(session *xorm.Session) error) error {
+	timeout := a.lockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dbType := a.engine.Dialect().URI().DBType
+	if dbType != schemas.POSTGRES && dbType != schemas.MYSQL {
+		// The row of the lock table is inserted before the transaction, so that it is seen by the others.
+		unlock, err := a.lockTable(lockCtx)
+		if err != nil {
+			return lockError(err)
+		}
+		defer unlock()
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		return err
+	}
+
+	var release func()
+	var err error
+	switch dbType {
+	case schemas.POSTGRES:
+		err = a.lockPostgres(lockCtx, session)
+	case schemas.MYSQL:
+		release, err = a.lockMySQL(lockCtx, session, timeout)
+	}
+	if err != nil {
+		_ = session.Rollback()
+		return lockError(err)
+	}
+
+	err = fn(session)
+	if release != nil {
+		release()
+	}
+	if err != nil {
+		_ = session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+func lockError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// retryLock calls try until it takes the lock or ctx is done.
+func retryLock(ctx context.Context, try func() (bool, error)) error {
+	for {
+		ok, err := try()
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// lockPostgres takes a transaction-level advisory lock, released at the end of the
+// transaction of session.
+func (a *Adapter) lockPostgres(ctx context.Context, session *xorm.Session) error {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(a.lockName()))
+	key := int64(hash.Sum64() & math.MaxInt64)
+
+	return retryLock(ctx, func() (bool, error) {
+		var ok bool
+		err := session.Tx().QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", key).Scan(&ok)
+		return ok, err
+	})
+}
+
+// lockMySQL takes a named lock on the connection of the transaction of session. Named locks
+// aren't released by the end of the transaction, the returned function releases it before,
+// while the connection is still held.
+func (a *Adapter) lockMySQL(ctx context.Context, session *xorm.Session, timeout time.Duration) (func(), error) {
+	name := a.lockName()
+	var ok sql.NullInt64
+	err := session.Tx().QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int64(math.Ceil(timeout.Seconds()))).Scan(&ok)
+	if err == nil && (!ok.Valid || ok.Int64 != 1) {
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_, _ = session.Tx().ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+	}, nil
+}
+
+func (a *Adapter) lockTable(ctx context.Context) (func(), error) {
+	tableName := a.ruleTableName() + "_lock"
+	session := a.engine.NewSession()
+	err := a.sync(session, &policyLock{tableName: tableName})
+	session.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	name := a.lockName()
+	err = retryLock(ctx, func() (bool, error) {
+		stale := time.Now().Add(-lockStaleAfter).In(a.engine.DatabaseTZ).Format("2006-01-02 15:04:05")
+		_, err := a.engine.Context(ctx).Where("name = ? AND created < ?", name, stale).Delete(&policyLock{tableName: tableName})
+		if err != nil {
+			return false, err
+		}
+
+		exist, err := a.engine.Context(ctx).Table(&policyLock{tableName: tableName}).Where("name = ?", name).Exist()
+		if err != nil || exist {
+			return false, err
+		}
+		// Another process may insert the row in the meantime, the primary key lets only one succeed.
+		_, err = a.engine.Context(ctx).InsertOne(&policyLock{Name: name, Owner: a.instanceID(), tableName: tableName})
+		if err != nil {
+			// The other errors are returned, instead of waiting for the lock until the timeout.
+			if exist, _ = a.engine.Context(ctx).Table(&policyLock{tableName: tableName}).Where("name = ?", name).Exist(); exist {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_, _ = a.engine.Where("name = ? AND owner = ?", name, a.instanceID()).Delete(&policyLock{tableName: tableName})
+	}, nil
+}
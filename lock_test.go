@@ -0,0 +1,111 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"xorm.io/xorm"
+)
+
+func TestLock(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a1, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a2, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithLockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- a1.withLock(context.Background(), func(*xorm.Session) error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	if err = a2.SavePolicy(e.GetModel()); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("SavePolicy should time out waiting for the lock, err: %v", err)
+	}
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatalf("withLock failed, err: %v", err)
+	}
+	if err = a2.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("SavePolicy failed after the lock was released, err: %v", err)
+	}
+	e2, _ := casbin.NewEnforcer("examples/rbac_model.conf", a1)
+	testGetPolicyWithoutOrder(t, e2, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestLockSingleConnection(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "casbin.db"))
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	defer engine.Close()
+	engine.SetMaxOpenConns(1)
+
+	// The locked work runs on the connection of the lock, instead of waiting for another one.
+	a, err := NewAdapterByEngineWithOptions(engine, WithChangeLog(), WithHistory(), WithOptimisticLocking(), WithAuditLog(nil))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err = a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("SavePolicy failed, err: %v", err)
+	}
+	if _, err = a.Migrate(context.Background(), AddIDMigration(1)); err != nil {
+		t.Fatalf("Migrate failed, err: %v", err)
+	}
+	if err = a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("SavePolicy failed after the migration, err: %v", err)
+	}
+	e2, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e2, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestLockTableError(t *testing.T) {
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), WithLockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	// The insert of the lock fails, like without the rights to write the lock table.
+	_, err = a.engine.Exec("CREATE TRIGGER casbin_rule_lock_denied BEFORE INSERT ON casbin_rule_lock BEGIN SELECT RAISE(ABORT, 'denied'); END")
+	if err != nil {
+		t.Fatalf("failed to create the trigger, err: %v", err)
+	}
+	err = a.withLock(context.Background(), func(*xorm.Session) error {
+		t.Error("fn shouldn't run without the lock")
+		return nil
+	})
+	if err == nil || errors.Is(err, ErrLockTimeout) {
+		t.Errorf("withLock returned err: %v, supposed to be the error of the insert", err)
+	}
+}
@@ -0,0 +1,480 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/dialects"
+	"xorm.io/xorm/schemas"
+)
+
+// Migration is a versioned change of the schema or the data of the policy table,
+// applied once by Migrate.
+type Migration struct {
+	// Version orders the migrations, it must be positive and unique.
+	Version     int64
+	Description string
+	// Up applies the migration, running its statements through m.
+	Up func(ctx context.Context, m *Migrator) error
+}
+
+// MigrationStatement is a statement run by a migration.
+type MigrationStatement struct {
+	SQL  string
+	Args []interface{}
+}
+
+// MigrationResult describes a migration applied by Migrate, or to be applied by MigrateDryRun.
+type MigrationResult struct {
+	Version     int64
+	Description string
+	Statements  []MigrationStatement
+}
+
+// Migrator runs the statements of a migration, or only records them in a dry run.
+type Migrator struct {
+	adapter *Adapter
+	session *xorm.Session
+	// table is the policy table being migrated.
+	table      string
+	dryRun     bool
+	statements []MigrationStatement
+}
+
+// schemaVersion is a migration applied to the policy table, stored in the schema version table.
+type schemaVersion struct {
+	Version     int64     `xorm:"pk"`
+	Description string    `xorm:"varchar(255) not null default ''"`
+	Applied     time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the schema version table.
+func (v *schemaVersion) TableName() string {
+	return v.tableName
+}
+
+func (a *Adapter) schemaVersionTableName() string {
+	return a.ruleTableName() + "_schema_version"
+}
+
+// migrated reports whether migrations have been applied to the policy table.
+func (a *Adapter) migrated(session *xorm.Session) (bool, error) {
+	tableName := a.schemaVersionTableName()
+	exist, err := session.IsTableExist(tableName)
+	if err != nil || !exist {
+		return false, err
+	}
+	return session.Table(tableName).Exist()
+}
+
+// DBType returns the type of the database.
+func (m *Migrator) DBType() schemas.DBType {
+	return m.adapter.engine.Dialect().URI().DBType
+}
+
+// TableName returns the name of the policy table being migrated, qualified with the schema
+// if any, see WithSchema.
+func (m *Migrator) TableName() string {
+	return dialects.TableNameWithSchema(m.adapter.engine.Dialect(), m.table)
+}
+
+// Quote quotes the name of a table or a column.
+func (m *Migrator) Quote(name string) string {
+	return m.adapter.engine.Quote(name)
+}
+
+// Exec runs a statement changing the database, unless in a dry run, and records it.
+func (m *Migrator) Exec(query string, args ...interface{}) error {
+	m.statements = append(m.statements, MigrationStatement{SQL: query, Args: args})
+	if m.dryRun {
+		return nil
+	}
+	_, err := m.session.Exec(append([]interface{}{query}, args...)...)
+	return err
+}
+
+// Query runs a statement reading the database, in a dry run as well.
+func (m *Migrator) Query(query string, args ...interface{}) ([]map[string]string, error) {
+	return m.session.QueryString(append([]interface{}{query}, args...)...)
+}
+
+// Migrate applies the migrations which haven't been applied yet to the policy table, in the
+// order of their versions, and returns them. With WithTableRouting, each migration is applied
+// to every policy table, the Up function being called once per table. The applied versions
+// are stored in a table named after the policy table with a "_schema_version" suffix.
+// The migrations run holding the lock of the policy table, so that only one process applies
+// them, in its transaction: a failed migration rolls back the ones applied by the same call,
+// except for the statements changing the schema on MySQL, which commit it. Once a migration
+// has been applied, SavePolicy deletes the rules instead of recreating the policy table.
+func (a *Adapter) Migrate(ctx context.Context, migrations ...Migration) ([]MigrationResult, error) {
+	return a.migrate(ctx, migrations, false)
+}
+
+// MigrateDryRun returns the migrations which Migrate would apply, with their statements,
+// without changing the database. The statements of a migration depending on the changes
+// of the previous ones may differ from the ones run by Migrate.
+func (a *Adapter) MigrateDryRun(ctx context.Context, migrations ...Migration) ([]MigrationResult, error) {
+	return a.migrate(ctx, migrations, true)
+}
+
+func (a *Adapter) migrate(ctx context.Context, migrations []Migration, dryRun bool) ([]MigrationResult, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i, migration := range sorted {
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("the version %d of the migration %q isn't positive", migration.Version, migration.Description)
+		}
+		if i > 0 && sorted[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("the version %d is used by several migrations", migration.Version)
+		}
+	}
+
+	results := make([]MigrationResult, 0, len(sorted))
+	err := a.withLock(ctx, func(session *xorm.Session) error {
+		applied, err := a.appliedMigrations(session, dryRun)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range sorted {
+			if applied[migration.Version] {
+				continue
+			}
+			statements, err := a.runMigration(ctx, session, migration, dryRun)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+			}
+			results = append(results, MigrationResult{
+				Version:     migration.Version,
+				Description: migration.Description,
+				Statements:  statements,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// appliedMigrations returns the versions of the applied migrations,
+// creating the schema version table unless in a dry run.
+func (a *Adapter) appliedMigrations(session *xorm.Session, dryRun bool) (map[int64]bool, error) {
+	tableName := a.schemaVersionTableName()
+	if dryRun {
+		exist, err := session.IsTableExist(tableName)
+		if err != nil || !exist {
+			return map[int64]bool{}, err
+		}
+	} else {
+		// The migrations change the schema anyway, the table is created with WithoutSchemaSync as well.
+		if err := session.Sync2(&schemaVersion{tableName: tableName}); err != nil {
+			return nil, err
+		}
+	}
+
+	versions := make([]*schemaVersion, 0)
+	if err := session.Table(tableName).Find(&versions); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v.Version] = true
+	}
+	return applied, nil
+}
+
+// runMigration applies migration in the transaction of session, which is rolled back by the
+// caller on error.
+func (a *Adapter) runMigration(ctx context.Context, session *xorm.Session, migration Migration, dryRun bool) ([]MigrationStatement, error) {
+	m := &Migrator{adapter: a, session: session, dryRun: dryRun}
+	if err := m.up(ctx, migration); err != nil || dryRun {
+		return m.statements, err
+	}
+
+	_, err := session.InsertOne(&schemaVersion{
+		Version:     migration.Version,
+		Description: migration.Description,
+		tableName:   a.schemaVersionTableName(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.statements, nil
+}
+
+// up applies migration to each policy table.
+func (m *Migrator) up(ctx context.Context, migration Migration) error {
+	for _, table := range m.adapter.ruleTables() {
+		m.table = table
+		if err := migration.Up(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleColumnNames returns the columns of the policy table holding the fields of the rules.
+func (a *Adapter) ruleColumnNames() []string {
+	names := make([]string, 0, len(ruleColumns))
+	for idx := range ruleColumns {
+		if name := a.columnName(idx); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// AddIDMigration returns a migration adding an auto-incremented "id" primary key to the policy
+// table. On SQLite, which can't add a primary key to a table, the table is rebuilt.
+func AddIDMigration(version int64) Migration {
+	return Migration{
+		Version:     version,
+		Description: "add an id primary key to the policy table",
+		Up: func(ctx context.Context, m *Migrator) error {
+			table, id := m.Quote(m.TableName()), m.Quote("id")
+			switch m.DBType() {
+			case schemas.MYSQL:
+				return m.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST", table, id))
+			case schemas.POSTGRES:
+				return m.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s BIGSERIAL PRIMARY KEY", table, id))
+			case schemas.MSSQL:
+				return m.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY", table, id))
+			case schemas.SQLITE:
+				return m.rebuildWithID(ctx)
+			default:
+				return fmt.Errorf("adding the id column isn't supported on %s", m.DBType())
+			}
+		},
+	}
+}
+
+// rebuildWithID copies the policy table to a new table with an id primary key.
+func (m *Migrator) rebuildWithID(ctx context.Context) error {
+	dialect := m.adapter.engine.Dialect()
+	tableName := m.table
+	newName := tableName + "_migrate"
+
+	cols, columns, err := dialect.GetColumns(queryer(m.session), ctx, tableName)
+	if err != nil {
+		return err
+	}
+	indexes, err := dialect.GetIndexes(queryer(m.session), ctx, tableName)
+	if err != nil {
+		return err
+	}
+
+	table := schemas.NewEmptyTable()
+	table.Name = newName
+	table.AddColumn(&schemas.Column{
+		Name:            "id",
+		SQLType:         schemas.SQLType{Name: schemas.Integer},
+		Nullable:        false,
+		IsPrimaryKey:    true,
+		IsAutoIncrement: true,
+	})
+	for _, name := range cols {
+		table.AddColumn(columns[name])
+	}
+	createTable, _, err := dialect.CreateTableSQL(ctx, nil, table, newName)
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, 0, len(cols))
+	for _, name := range cols {
+		quoted = append(quoted, m.Quote(name))
+	}
+	stmts := []string{
+		createTable,
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", m.Quote(newName), strings.Join(quoted, ", "), strings.Join(quoted, ", "), m.Quote(tableName)),
+		fmt.Sprintf("DROP TABLE %s", m.Quote(tableName)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", m.Quote(newName), m.Quote(tableName)),
+	}
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stmts = append(stmts, dialect.CreateIndexSQL(tableName, indexes[name]))
+	}
+
+	for _, stmt := range stmts {
+		if err = m.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WidenColumnsMigration returns a migration changing the columns of the fields of the rules to
+// VARCHAR(size). It changes nothing on SQLite, whose columns aren't limited.
+func WidenColumnsMigration(version int64, size int) Migration {
+	return Migration{
+		Version:     version,
+		Description: fmt.Sprintf("widen the columns of the policy table to %d characters", size),
+		Up: func(ctx context.Context, m *Migrator) error {
+			table := m.Quote(m.TableName())
+			names := m.adapter.ruleColumnNames()
+			switch m.DBType() {
+			case schemas.MYSQL:
+				for _, name := range names {
+					if err := m.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s VARCHAR(%d) NOT NULL DEFAULT ''", table, m.Quote(name), size)); err != nil {
+						return err
+					}
+				}
+			case schemas.POSTGRES:
+				for _, name := range names {
+					if err := m.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE VARCHAR(%d)", table, m.Quote(name), size)); err != nil {
+						return err
+					}
+				}
+			case schemas.MSSQL:
+				return m.widenMSSQL(ctx, names, size)
+			case schemas.SQLITE:
+			default:
+				return fmt.Errorf("widening the columns isn't supported on %s", m.DBType())
+			}
+			return nil
+		},
+	}
+}
+
+// widenMSSQL widens the columns, dropping and recreating their indexes, which MSSQL requires.
+func (m *Migrator) widenMSSQL(ctx context.Context, names []string, size int) error {
+	dialect := m.adapter.engine.Dialect()
+	tableName := m.table
+	indexes, err := dialect.GetIndexes(queryer(m.session), ctx, tableName)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if err = m.Exec(dialect.DropIndexSQL(tableName, index)); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err = m.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s VARCHAR(%d) NOT NULL", m.Quote(tableName), m.Quote(name), size)); err != nil {
+			return err
+		}
+	}
+	for _, index := range indexes {
+		if err = m.Exec(dialect.CreateIndexSQL(tableName, index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTimestampsMigration returns a migration adding the "created" and "updated" columns to the
+// policy table, set to the time of the migration on the existing rules. The new rules get the
+// time of their insertion, except on SQLite which can't add a column defaulting to it, and the
+// updated column follows the changes of the rules on MySQL only.
+func AddTimestampsMigration(version int64) Migration {
+	return Migration{
+		Version:     version,
+		Description: "add the creation and update times to the policy table",
+		Up: func(ctx context.Context, m *Migrator) error {
+			table, created, updated := m.Quote(m.TableName()), m.Quote("created"), m.Quote("updated")
+			var stmts []string
+			switch m.DBType() {
+			case schemas.MYSQL:
+				stmts = []string{
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s DATETIME NULL DEFAULT CURRENT_TIMESTAMP", table, created),
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s DATETIME NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP", table, updated),
+				}
+			case schemas.POSTGRES:
+				stmts = []string{
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP", table, created),
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP", table, updated),
+				}
+			case schemas.MSSQL:
+				stmts = []string{
+					fmt.Sprintf("ALTER TABLE %s ADD %s DATETIME NULL DEFAULT CURRENT_TIMESTAMP WITH VALUES", table, created),
+					fmt.Sprintf("ALTER TABLE %s ADD %s DATETIME NULL DEFAULT CURRENT_TIMESTAMP WITH VALUES", table, updated),
+				}
+			case schemas.SQLITE:
+				stmts = []string{
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s DATETIME NULL", table, created),
+					fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s DATETIME NULL", table, updated),
+					fmt.Sprintf("UPDATE %s SET %s = CURRENT_TIMESTAMP, %s = CURRENT_TIMESTAMP", table, created, updated),
+				}
+			default:
+				return fmt.Errorf("adding the timestamps isn't supported on %s", m.DBType())
+			}
+			for _, stmt := range stmts {
+				if err := m.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// DedupeMigration returns a migration keeping a single row of the rules stored several times
+// in the policy table. The extra columns of the duplicated rows are reset.
+func DedupeMigration(version int64) Migration {
+	return Migration{
+		Version:     version,
+		Description: "remove the duplicated rules of the policy table",
+		Up: func(ctx context.Context, m *Migrator) error {
+			table := m.Quote(m.TableName())
+			names := m.adapter.ruleColumnNames()
+			if m.adapter.tenantColumn != "" {
+				// The same rule of different tenants isn't duplicated.
+				names = append(names, m.adapter.tenantColumn)
+			}
+			quoted := make([]string, 0, len(names))
+			conds := make([]string, 0, len(names))
+			for _, name := range names {
+				quoted = append(quoted, m.Quote(name))
+				conds = append(conds, m.Quote(name)+" = ?")
+			}
+			cols := strings.Join(quoted, ", ")
+
+			rows, err := m.Query(fmt.Sprintf("SELECT %s FROM %s GROUP BY %s HAVING COUNT(*) > 1", cols, table, cols))
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				args := make([]interface{}, 0, len(names))
+				for _, name := range names {
+					args = append(args, row[name])
+				}
+				if err = m.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(conds, " AND ")), args...); err != nil {
+					return err
+				}
+				placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+				if err = m.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, cols, placeholders), args...); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
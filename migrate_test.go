@@ -0,0 +1,122 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	owner, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, owner)
+	if _, err = owner.engine.Exec("INSERT INTO casbin_rule (ptype, v0, v1, v2) VALUES ('p', 'alice', 'data1', 'read'), ('p', 'alice', 'data1', 'read')"); err != nil {
+		t.Fatalf("failed to insert the duplicates, err: %v", err)
+	}
+
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithoutSchemaSync())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	migrations := []Migration{
+		DedupeMigration(3),
+		AddIDMigration(1),
+		WidenColumnsMigration(2, 255),
+		AddTimestampsMigration(4),
+	}
+
+	// The dry run changes nothing.
+	results, err := a.MigrateDryRun(ctx, migrations...)
+	if err != nil {
+		t.Fatalf("MigrateDryRun failed, err: %v", err)
+	}
+	if len(results) != 4 || results[0].Version != 1 || len(results[0].Statements) == 0 || len(results[1].Statements) != 0 || len(results[2].Statements) != 2 {
+		t.Fatalf("MigrateDryRun = %+v", results)
+	}
+	if exist, _ := a.engine.IsTableExist(a.schemaVersionTableName()); exist {
+		t.Error("the dry run has created the schema version table")
+	}
+	if count, _ := a.engine.Table("casbin_rule").Count(); count != 7 {
+		t.Errorf("%d rows after the dry run, supposed to be 7", count)
+	}
+
+	results, err = a.Migrate(ctx, migrations...)
+	if err != nil {
+		t.Fatalf("Migrate failed, err: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Migrate = %+v", results)
+	}
+	columns, _, err := a.engine.Dialect().GetColumns(a.engine.DB(), ctx, "casbin_rule")
+	if err != nil {
+		t.Fatalf("failed to read the columns, err: %v", err)
+	}
+	if columns[0] != "id" || columns[len(columns)-2] != "created" || columns[len(columns)-1] != "updated" {
+		t.Errorf("the columns are %v after the migrations", columns)
+	}
+	if count, _ := a.engine.Table("casbin_rule").Where("created IS NULL OR updated IS NULL").Count(); count != 0 {
+		t.Errorf("%d rows without timestamps", count)
+	}
+	if count, _ := a.engine.Table("casbin_rule").Count(); count != 5 {
+		t.Errorf("%d rows after the dedupe, supposed to be 5", count)
+	}
+	if count, _ := a.engine.Table("casbin_rule").Where("id IS NULL").Count(); count != 0 {
+		t.Errorf("%d rows without id", count)
+	}
+
+	// The applied migrations are skipped.
+	results, err = a.Migrate(ctx, append(migrations, Migration{
+		Version:     5,
+		Description: "noop",
+		Up:          func(ctx context.Context, m *Migrator) error { return nil },
+	})...)
+	if err != nil || len(results) != 1 || results[0].Version != 5 {
+		t.Fatalf("Migrate = %+v, err: %v", results, err)
+	}
+
+	// The adapter works with the migrated table.
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	// SavePolicy keeps the migrated table, even when the adapter syncs the schema.
+	ownerEnforcer, _ := casbin.NewEnforcer("examples/rbac_model.conf", owner)
+	if err = ownerEnforcer.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy failed, err: %v", err)
+	}
+	columns, _, err = a.engine.Dialect().GetColumns(a.engine.DB(), ctx, "casbin_rule")
+	if err != nil {
+		t.Fatalf("failed to read the columns, err: %v", err)
+	}
+	if columns[0] != "id" || columns[len(columns)-1] != "updated" {
+		t.Errorf("the columns are %v after SavePolicy", columns)
+	}
+	if count, _ := a.engine.Table("casbin_rule").Where("id IS NULL").Count(); count != 0 || len(ownerEnforcer.GetPolicy()) != 4 {
+		t.Errorf("%d rows without id after SavePolicy", count)
+	}
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+
+	if _, err = a.Migrate(ctx, AddIDMigration(1), DedupeMigration(1)); err == nil {
+		t.Error("migrations with the same version should be rejected")
+	}
+}
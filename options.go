@@ -0,0 +1,299 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"time"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// Option configures an Adapter created by NewAdapterWithOptions or NewAdapterByEngineWithOptions.
+type Option func(a *Adapter)
+
+// WithTableName sets the name and the prefix of the policy table.
+func WithTableName(tableName string, tablePrefix string) Option {
+	return func(a *Adapter) {
+		a.tableName = tableName
+		a.tablePrefix = tablePrefix
+	}
+}
+
+// WithDBSpecified tells the adapter that the DB in dataSourceName exists,
+// instead of creating a DB named "casbin", see NewAdapter.
+func WithDBSpecified(dbSpecified bool) Option {
+	return func(a *Adapter) {
+		a.dbSpecified = dbSpecified
+	}
+}
+
+// WithChangeLog makes the adapter append every change of the policy to a change-log table,
+// which allows LoadPolicyDelta to apply only the changes since the last load.
+func WithChangeLog() Option {
+	return func(a *Adapter) {
+		a.changeLog = true
+	}
+}
+
+// WithChangeLogPollInterval sets how often Subscribe polls the change log for the changes
+// made by other adapters, the default is one second.
+func WithChangeLogPollInterval(interval time.Duration) Option {
+	return func(a *Adapter) {
+		a.pollInterval = interval
+	}
+}
+
+// WithHistory enables the change log in history mode, where the rules written by SavePolicy
+// are recorded as well, so that LoadPolicyAt can reconstruct the policy at any time since
+// history mode has been enabled. Every adapter writing to the policy table must use it.
+func WithHistory() Option {
+	return func(a *Adapter) {
+		a.changeLog = true
+		a.history = true
+	}
+}
+
+// WithAuditLog makes the adapter record every change of the policy in an audit table, named
+// after the policy table with an "_audit" suffix, in the same transaction as the change.
+// The actor of the change is taken from the value stored under actorKey in the context
+// passed to the *Ctx methods, if any. With WithTenantColumn, the records hold the tenant
+// of the change.
+func WithAuditLog(actorKey interface{}) Option {
+	return func(a *Adapter) {
+		a.audit = true
+		a.auditActorKey = actorKey
+	}
+}
+
+// WithOptimisticLocking makes SavePolicy fail with ErrPolicyConflict if the policy has been
+// changed since it was loaded, instead of overwriting the changes, ForceSavePolicy overwrites
+// them anyway. The version of the policy is incremented by every write, so every adapter
+// writing to the policy table must use it. The version is recorded per enforcer by the
+// adapters returned by ForEnforcer.
+func WithOptimisticLocking() Option {
+	return func(a *Adapter) {
+		a.optimistic = true
+	}
+}
+
+// WithLockTimeout sets how long SavePolicy and the creation of the tables wait for the
+// database-level lock of the policy table before failing with ErrLockTimeout,
+// the default is 30 seconds.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(a *Adapter) {
+		a.lockTimeout = timeout
+	}
+}
+
+// WithRuleType makes the adapter create the policy table from bean, a pointer to a struct
+// embedding CasbinRule with the `xorm:"extends"` tag and declaring extra columns, such as:
+//
+//	type Rule struct {
+//		xormadapter.CasbinRule `xorm:"extends"`
+//		TenantID               string `xorm:"'tenant_id' varchar(100) not null default ''"`
+//	}
+//
+// Every inserted rule is a new value of that struct, whose extra columns are populated
+// by hook, if not nil. The extra columns are ignored when loading the policy.
+func WithRuleType(bean interface{}, hook RuleHook) Option {
+	return func(a *Adapter) {
+		a.ruleType = reflect.TypeOf(bean)
+		if a.ruleType.Kind() == reflect.Ptr {
+			a.ruleType = a.ruleType.Elem()
+		}
+		a.ruleHook = hook
+	}
+}
+
+// WithExistingTable makes the adapter use an existing policy table, which is neither created
+// nor synced. The columns of the table can be given in the order of the fields of the rules:
+// the column of the ptype, then the columns of v0, v1 and so on. A table with fewer columns
+// can only store rules with fewer values. Without columns, the default names are used.
+func WithExistingTable(tableName string, columns ...string) Option {
+	return func(a *Adapter) {
+		a.tableName = tableName
+		a.tablePrefix = ""
+		a.existingTable = true
+		if len(columns) > 0 {
+			a.columns = columns
+		}
+	}
+}
+
+// WithoutDatabaseCreation keeps the adapter from creating the DB named "casbin" when the DB
+// isn't specified in dataSourceName, the DB must exist.
+func WithoutDatabaseCreation() Option {
+	return func(a *Adapter) {
+		a.skipCreateDB = true
+	}
+}
+
+// WithoutSchemaSync keeps the adapter from creating, altering or dropping any table, for
+// database users without DDL rights: the tables must be created beforehand, VerifySchema
+// checks that they are. SavePolicy deletes the rules instead of recreating the table.
+func WithoutSchemaSync() Option {
+	return func(a *Adapter) {
+		a.skipSync = true
+	}
+}
+
+// WithFeatures declares the features used with the adapter whose tables are created when they
+// are first used, so that VerifySchema checks their tables and GenerateDDL generates them.
+func WithFeatures(features ...Feature) Option {
+	return func(a *Adapter) {
+		a.features = append(a.features, features...)
+	}
+}
+
+// WithColumnType sets the type of the column of field, one of "ptype" and "v0" to "v5", in the
+// tables created by the adapter, VARCHAR(100) by default. The values longer than the column
+// allows are rejected with ErrValueTooLong, the columns of SQLite and of WithExistingTable
+// being only limited when configured. The types of the existing columns aren't changed,
+// see WidenColumnsMigration.
+func WithColumnType(field string, columnType ColumnType) Option {
+	return func(a *Adapter) {
+		if a.columnTypes == nil {
+			a.columnTypes = make(map[string]ColumnType)
+		}
+		a.columnTypes[field] = columnType
+	}
+}
+
+// WithIndexStrategy selects the indexes of the policy table created by the adapter, such as
+// composite indexes matching the filters of the application:
+//
+//	xormadapter.WithIndexStrategy(xormadapter.IndexComposite, []string{"ptype", "v0"}, []string{"ptype", "v1"})
+//
+// The indexes of an existing table aren't changed, see IndexMigration.
+func WithIndexStrategy(strategy IndexStrategy, composite ...[]string) Option {
+	return func(a *Adapter) {
+		a.indexStrategy = strategy
+		a.compositeIndexes = composite
+	}
+}
+
+// WithSchema makes the adapter use the tables of schema on Postgres, instead of the "public"
+// schema, by setting the schema of the engine it opens. The schema must exist.
+// The engine passed to NewAdapterByEngineWithOptions isn't changed, it must already use the schema.
+func WithSchema(schema string) Option {
+	return func(a *Adapter) {
+		a.schema = schema
+	}
+}
+
+// WithMySQLTableOptions sets the charset, the collation and the storage engine of the tables
+// created by the adapter on MySQL, such as "utf8mb4", "utf8mb4_bin" and "InnoDB".
+// The empty ones are left to the defaults of the database.
+func WithMySQLTableOptions(charset string, collation string, storeEngine string) Option {
+	return func(a *Adapter) {
+		a.charset = charset
+		a.collation = collation
+		a.storeEngine = storeEngine
+	}
+}
+
+// WithTableRouting stores the rules in several policy tables, each with its own indexes:
+// routes maps a ptype, such as "g2", or a section, "p" or "g", to the name of the table of its
+// rules. A ptype is routed to its own table if any, else to the table of its section, which is
+// the first letter of the ptype, else to the default policy table, see WithTableName:
+//
+//	xormadapter.WithTableRouting(map[string]string{"g": "casbin_role", "g2": "casbin_domain"})
+//
+// The tables of the change log, the audit trail, the lock and the other features are still
+// named after the default policy table.
+func WithTableRouting(routes map[string]string) Option {
+	return func(a *Adapter) {
+		a.routes = make(map[string]string, len(routes))
+		for ptype, table := range routes {
+			a.routes[ptype] = table
+		}
+	}
+}
+
+// WithTenantColumn scopes the rules by tenant, stored in column of the policy tables. The column
+// is added to the policy tables synced by the adapter and put first in the indexes of the tables
+// it creates, IndexMigration changes the indexes of the existing ones.
+// The tenant is written on every insert and added to the condition of every load, update and
+// delete, so that the rules of the other tenants are never seen. The adapter is bound to tenant,
+// which the context can override, see WithTenantKey. SavePolicy deletes the rules of the tenant
+// instead of recreating the tables. The entries of the change log and the versions of
+// optimistic locking are scoped by tenant too. Snapshots and dispatchers, which would share
+// their data between the tenants, can't be used.
+func WithTenantColumn(column string, tenant string) Option {
+	return func(a *Adapter) {
+		a.tenantColumn = column
+		a.tenantValue = tenant
+	}
+}
+
+// WithTenantKey makes the value stored under key in the context passed to the *Ctx methods,
+// if any, the tenant of the rules, instead of the one of the adapter, see WithTenantColumn.
+// The methods without a context use the tenant of the adapter.
+func WithTenantKey(key interface{}) Option {
+	return func(a *Adapter) {
+		a.tenantKey = key
+	}
+}
+
+// NewAdapterWithOptions is the constructor for Adapter with options.
+func NewAdapterWithOptions(driverName string, dataSourceName string, opts ...Option) (*Adapter, error) {
+	a := &Adapter{
+		driverName:     driverName,
+		dataSourceName: dataSourceName,
+		sharedState:    &sharedState{},
+		loadedPolicy:   &loadedPolicy{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	// Open the DB, create it if not existed.
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	// Call the destructor when the object is released.
+	runtime.SetFinalizer(a, finalizer)
+
+	return a, nil
+}
+
+// NewAdapterByEngineWithOptions is the constructor for Adapter with an existing engine and options.
+func NewAdapterByEngineWithOptions(engine *xorm.Engine, opts ...Option) (*Adapter, error) {
+	a := &Adapter{
+		engine:       engine,
+		sharedState:  &sharedState{},
+		loadedPolicy: &loadedPolicy{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	// The engine belongs to the caller, its schema is left untouched.
+	if uri := engine.Dialect().URI(); a.schema != "" && uri.DBType == schemas.POSTGRES && uri.Schema != a.schema {
+		return nil, fmt.Errorf("the engine uses the schema %q instead of %q, set it with SetSchema", uri.Schema, a.schema)
+	}
+
+	err := a.createTable()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
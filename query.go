@@ -0,0 +1,404 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"xorm.io/xorm/schemas"
+)
+
+var ruleColumns = []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+
+// PolicyRow is a policy rule as stored in the database.
+type PolicyRow struct {
+	Ptype string
+	Rule  []string
+}
+
+// Page selects the slice of policy rules returned by QueryPolicies.
+type Page struct {
+	// Limit is the maximum number of rows to return, 0 means no limit.
+	Limit int
+	// Offset is the number of rows to skip, it is only applied together with Limit
+	// and ignored when Cursor is set.
+	Offset int
+	// Cursor continues after the last row of a previous page, see QueryResult.NextCursor.
+	// It must be used with the same OrderBy as the page it was returned for.
+	Cursor string
+	// OrderBy lists the columns to sort by ("ptype", "v0" ... "v5"),
+	// a column prefixed with "-" is sorted in descending order.
+	// The remaining columns are always appended so that the order is stable.
+	OrderBy []string
+}
+
+// QueryResult is a page of policy rules returned by QueryPolicies.
+type QueryResult struct {
+	Rows []PolicyRow
+	// Total is the number of rules matching the filter, regardless of the page.
+	Total int64
+	// NextCursor can be used as Page.Cursor to fetch the next page,
+	// it is empty when there are no more rows.
+	NextCursor string
+}
+
+type orderColumn struct {
+	idx  int
+	desc bool
+}
+
+func (c *CasbinRule) values() []string {
+	return []string{c.Ptype, c.V0, c.V1, c.V2, c.V3, c.V4, c.V5}
+}
+
+func (c *CasbinRule) toPolicyRow() PolicyRow {
+	values := c.values()
+	n := len(values)
+	for n > 1 && values[n-1] == "" {
+		n--
+	}
+	return PolicyRow{Ptype: c.Ptype, Rule: values[1:n]}
+}
+
+func parseOrderBy(orderBy []string) ([]orderColumn, error) {
+	columns := make([]orderColumn, 0, len(ruleColumns))
+	seen := make(map[int]bool, len(ruleColumns))
+	for _, col := range orderBy {
+		desc := strings.HasPrefix(col, "-")
+		name := strings.ToLower(strings.TrimPrefix(col, "-"))
+		idx := -1
+		for i, c := range ruleColumns {
+			if c == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid order by column: %s", col)
+		}
+		if seen[idx] {
+			continue
+		}
+		seen[idx] = true
+		columns = append(columns, orderColumn{idx: idx, desc: desc})
+	}
+	for idx := range ruleColumns {
+		if !seen[idx] {
+			columns = append(columns, orderColumn{idx: idx})
+		}
+	}
+	return columns, nil
+}
+
+func encodeCursor(line *CasbinRule) string {
+	data, _ := json.Marshal(line.values())
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) ([]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var values []string
+	if err = json.Unmarshal(data, &values); err != nil || len(values) != len(ruleColumns) {
+		return nil, errors.New("invalid cursor")
+	}
+	return values, nil
+}
+
+// cursorCondition builds the keyset condition selecting the rows after values in the given order.
+func (a *Adapter) cursorCondition(columns []orderColumn, values []string) (string, []interface{}) {
+	or := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns)*(len(columns)+1)/2)
+	for i, col := range columns {
+		and := make([]string, 0, i+1)
+		for _, prev := range columns[:i] {
+			and = append(and, a.columnExpr(prev.idx)+" = ?")
+			args = append(args, values[prev.idx])
+		}
+		op := " > ?"
+		if col.desc {
+			op = " < ?"
+		}
+		and = append(and, a.columnExpr(col.idx)+op)
+		args = append(args, values[col.idx])
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	return "(" + strings.Join(or, " OR ") + ")", args
+}
+
+// errPagingTables is returned when the rules of several policy tables would be paged on a
+// database whose order of the strings may differ from the byte order they are merged in.
+var errPagingTables = errors.New("the rules of several policy tables can only be paged on SQLite")
+
+// QueryPolicies returns a page of the policy rules that match the filter,
+// without loading them into a casbin model.
+// With WithTableRouting, the rules of several policy tables are merged in the byte order
+// of their strings. They can only be paged with a Limit or a Cursor on SQLite, which sorts
+// the strings in byte order unless the columns are given another collation.
+func (a *Adapter) QueryPolicies(ctx context.Context, filter Filter, page Page) (*QueryResult, error) {
+	if page.Limit < 0 || page.Offset < 0 {
+		return nil, fmt.Errorf("invalid page limit %d or offset %d", page.Limit, page.Offset)
+	}
+	tables := a.tablesOf(filter)
+	// Each table is read in the order of the database, the merged rows would skip or
+	// repeat some of them from one page to the next if it isn't the byte order.
+	if len(tables) > 1 && (page.Limit > 0 || page.Cursor != "") && a.engine.Dialect().URI().DBType != schemas.SQLITE {
+		return nil, errPagingTables
+	}
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := parseOrderBy(page.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	// The fields without a column are always empty and don't change the order.
+	present := columns[:0]
+	for _, col := range columns {
+		if a.columnName(col.idx) != "" {
+			present = append(present, col)
+		}
+	}
+	columns = present
+
+	var after []string
+	if page.Cursor != "" {
+		if after, err = decodeCursor(page.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	total, err := a.CountPolicies(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	orders := make([]string, 0, len(columns))
+	for _, col := range columns {
+		if col.desc {
+			orders = append(orders, a.columnExpr(col.idx)+" DESC")
+		} else {
+			orders = append(orders, a.columnExpr(col.idx)+" ASC")
+		}
+	}
+
+	lines := make([]*CasbinRule, 0, 64)
+	for _, table := range tables {
+		a.filterQuery(session, filter)
+		if after != nil {
+			cond, args := a.cursorCondition(columns, after)
+			session.And(cond, args...)
+		}
+		session.OrderBy(strings.Join(orders, ", "))
+
+		// Fetch one more row than requested to find out whether there is a next page.
+		// The offset of several tables is applied once they are merged.
+		if page.Limit > 0 {
+			if after != nil {
+				session.Limit(page.Limit + 1)
+			} else if len(tables) == 1 {
+				session.Limit(page.Limit+1, page.Offset)
+			} else {
+				session.Limit(page.Limit + 1 + page.Offset)
+			}
+		}
+
+		if err = a.rules(session, table, tenant).Find(&lines); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(tables) > 1 {
+		sort.SliceStable(lines, func(i, j int) bool {
+			return ruleLess(columns, lines[i], lines[j])
+		})
+		if page.Limit > 0 && after == nil {
+			if page.Offset > len(lines) {
+				page.Offset = len(lines)
+			}
+			lines = lines[page.Offset:]
+		}
+	}
+
+	result := &QueryResult{Total: total}
+	if page.Limit > 0 && len(lines) > page.Limit {
+		lines = lines[:page.Limit]
+		result.NextCursor = encodeCursor(lines[len(lines)-1])
+	}
+
+	result.Rows = make([]PolicyRow, 0, len(lines))
+	for _, line := range lines {
+		result.Rows = append(result.Rows, line.toPolicyRow())
+	}
+
+	return result, nil
+}
+
+// ruleLess reports whether x comes before y in the order of columns.
+func ruleLess(columns []orderColumn, x, y *CasbinRule) bool {
+	xv, yv := x.values(), y.values()
+	for _, col := range columns {
+		if xv[col.idx] != yv[col.idx] {
+			return (xv[col.idx] < yv[col.idx]) != col.desc
+		}
+	}
+	return false
+}
+
+// CountPolicies returns the number of policy rules that match the filter.
+func (a *Adapter) CountPolicies(ctx context.Context, filter Filter) (int64, error) {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	var total int64
+	for _, table := range a.tablesOf(filter) {
+		count, err := a.scope(a.filterQuery(session, filter), tenant).Count(&CasbinRule{tableName: table})
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// CountPoliciesByPtype returns the number of policy rules that match the filter for each ptype.
+func (a *Adapter) CountPoliciesByPtype(ctx context.Context, filter Filter) (map[string]int64, error) {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	var counts []struct {
+		Ptype string `xorm:"'ptype'"`
+		Count int64  `xorm:"'cnt'"`
+	}
+	ptypeCol := a.columnExpr(0)
+	for _, table := range a.tablesOf(filter) {
+		err := a.scope(a.filterQuery(session, filter), tenant).Table(table).
+			Select(ptypeCol + " AS ptype, COUNT(*) AS cnt").GroupBy(ptypeCol).Find(&counts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]int64, len(counts))
+	for _, c := range counts {
+		res[c.Ptype] += c.Count
+	}
+	return res, nil
+}
+
+// HasPolicy returns whether exactly the policy rule exists in the storage: every field is
+// compared, the fields after the end of the rule matching only empty values.
+func (a *Adapter) HasPolicy(ctx context.Context, ptype string, rule []string) (bool, error) {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return false, err
+	}
+	str, args, ok := a.exactCond(a.genPolicyLine(ptype, rule))
+	if !ok {
+		return false, nil
+	}
+	return a.scope(a.engine.Context(ctx).Table(a.tableFor(ptype)), tenant).Where(str, args...).Exist()
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![")
+
+// ListDistinctValues returns the distinct non-empty values of the field at fieldIndex
+// in the policy rules of ptype that match the filter, sorted in ascending order.
+// An empty ptype matches every ptype and a limit of 0 means no limit. If prefixes are
+// given, only the values starting with one of them are returned. The values of several
+// policy tables, see WithTableRouting, are merged in the byte order of their strings.
+func (a *Adapter) ListDistinctValues(ctx context.Context, ptype string, fieldIndex int, filter Filter, limit int, prefix ...string) ([]string, error) {
+	if fieldIndex < 0 || fieldIndex >= len(ruleColumns)-1 {
+		return nil, fmt.Errorf("invalid field index: %d", fieldIndex)
+	}
+	if a.columnName(fieldIndex+1) == "" {
+		return []string{}, nil
+	}
+	col := a.columnExpr(fieldIndex + 1)
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	tables := a.tablesOf(filter)
+	if ptype != "" {
+		tables = []string{a.tableFor(ptype)}
+	}
+	var like string
+	var likeArgs []interface{}
+	for _, p := range prefix {
+		if like != "" {
+			like += " OR "
+		}
+		like += col + " LIKE ? ESCAPE '!'"
+		likeArgs = append(likeArgs, likeEscaper.Replace(p)+"%")
+	}
+	values := make([]string, 0, 64)
+	for _, table := range tables {
+		a.scope(a.filterQuery(session.Table(table).Select("DISTINCT "+col).Where(col+" <> ''"), filter), tenant)
+		if ptype != "" {
+			session.And(a.columnExpr(0)+" = ?", ptype)
+		}
+		if like != "" {
+			session.And("("+like+")", likeArgs...)
+		}
+		session.OrderBy(col)
+		if limit > 0 {
+			session.Limit(limit)
+		}
+		if err := session.Find(&values); err != nil {
+			return nil, err
+		}
+	}
+	if len(tables) == 1 {
+		return values, nil
+	}
+
+	sort.Strings(values)
+	merged := values[:0]
+	for _, v := range values {
+		if len(merged) == 0 || v != merged[len(merged)-1] {
+			merged = append(merged, v)
+		}
+	}
+	if limit > 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestQueryPolicies(t *testing.T) {
+	a := newSQLiteAdapter(t)
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	res, err := a.QueryPolicies(ctx, Filter{Ptype: []string{"p"}}, Page{Limit: 3, OrderBy: []string{"-v0"}})
+	if err != nil {
+		t.Fatalf("QueryPolicies failed, err: %v", err)
+	}
+	if res.Total != 4 {
+		t.Errorf("Total: %d, supposed to be 4", res.Total)
+	}
+	want := []PolicyRow{
+		{Ptype: "p", Rule: []string{"data2_admin", "data2", "read"}},
+		{Ptype: "p", Rule: []string{"data2_admin", "data2", "write"}},
+		{Ptype: "p", Rule: []string{"bob", "data2", "write"}},
+	}
+	if !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("Rows: %v, supposed to be %v", res.Rows, want)
+	}
+	if res.NextCursor == "" {
+		t.Fatal("NextCursor should be set when more rows are available")
+	}
+
+	res, err = a.QueryPolicies(ctx, Filter{Ptype: []string{"p"}}, Page{Limit: 3, OrderBy: []string{"-v0"}, Cursor: res.NextCursor})
+	if err != nil {
+		t.Fatalf("QueryPolicies with cursor failed, err: %v", err)
+	}
+	want = []PolicyRow{{Ptype: "p", Rule: []string{"alice", "data1", "read"}}}
+	if !reflect.DeepEqual(res.Rows, want) || res.NextCursor != "" {
+		t.Errorf("Rows: %v, NextCursor: %q, supposed to be %v without cursor", res.Rows, res.NextCursor, want)
+	}
+
+	res, err = a.QueryPolicies(ctx, Filter{}, Page{Limit: 2, Offset: 4})
+	if err != nil {
+		t.Fatalf("QueryPolicies with offset failed, err: %v", err)
+	}
+	want = []PolicyRow{{Ptype: "p", Rule: []string{"data2_admin", "data2", "write"}}}
+	if !reflect.DeepEqual(res.Rows, want) || res.Total != 5 {
+		t.Errorf("Rows: %v, Total: %d, supposed to be %v and 5", res.Rows, res.Total, want)
+	}
+
+	if _, err = a.QueryPolicies(ctx, Filter{}, Page{OrderBy: []string{"id"}}); err == nil {
+		t.Error("QueryPolicies should reject unknown order by columns")
+	}
+	if _, err = a.QueryPolicies(ctx, Filter{}, Page{Cursor: "invalid"}); err == nil {
+		t.Error("QueryPolicies should reject invalid cursors")
+	}
+	if _, err = a.QueryPolicies(ctx, Filter{}, Page{Limit: 2, Offset: -1}); err == nil {
+		t.Error("QueryPolicies should reject negative offsets")
+	}
+	if _, err = a.QueryPolicies(ctx, Filter{}, Page{Limit: -1}); err == nil {
+		t.Error("QueryPolicies should reject negative limits")
+	}
+}
+
+func TestCountPolicies(t *testing.T) {
+	a := newSQLiteAdapter(t)
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	count, err := a.CountPolicies(ctx, Filter{V1: []string{"data2"}})
+	if err != nil {
+		t.Fatalf("CountPolicies failed, err: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("CountPolicies: %d, supposed to be 3", count)
+	}
+
+	counts, err := a.CountPoliciesByPtype(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("CountPoliciesByPtype failed, err: %v", err)
+	}
+	if want := map[string]int64{"p": 4, "g": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("CountPoliciesByPtype: %v, supposed to be %v", counts, want)
+	}
+
+	ok, err := a.HasPolicy(ctx, "p", []string{"bob", "data2", "write"})
+	if err != nil {
+		t.Fatalf("HasPolicy failed, err: %v", err)
+	}
+	if !ok {
+		t.Error("HasPolicy should find {bob, data2, write}")
+	}
+
+	ok, err = a.HasPolicy(ctx, "p", []string{"bob", "data2", "read"})
+	if err != nil {
+		t.Fatalf("HasPolicy failed, err: %v", err)
+	}
+	if ok {
+		t.Error("HasPolicy should not find {bob, data2, read}")
+	}
+
+	// A partial rule only matches a rule with the same fields.
+	ok, err = a.HasPolicy(ctx, "p", []string{"bob"})
+	if err != nil {
+		t.Fatalf("HasPolicy failed, err: %v", err)
+	}
+	if ok {
+		t.Error("HasPolicy should not find {bob}")
+	}
+	ok, err = a.HasPolicy(ctx, "p", []string{"bob", "data2", "write", ""})
+	if err != nil || !ok {
+		t.Errorf("HasPolicy = %v, err: %v, supposed to find {bob, data2, write, \"\"}", ok, err)
+	}
+}
+
+func TestListDistinctValues(t *testing.T) {
+	a := newSQLiteAdapter(t)
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	err := a.AddPolicies("p", "p", [][]string{{"data_%", "data1", "read"}, {"data2_admin", "data3", "read"}})
+	if err != nil {
+		t.Fatalf("AddPolicies failed, err: %v", err)
+	}
+
+	testCases := []struct {
+		ptype      string
+		fieldIndex int
+		filter     Filter
+		limit      int
+		prefix     []string
+		want       []string
+	}{
+		{"p", 0, Filter{}, 0, nil, []string{"alice", "bob", "data2_admin", "data_%"}},
+		{"p", 0, Filter{}, 2, nil, []string{"alice", "bob"}},
+		{"p", 0, Filter{}, 0, []string{"data_"}, []string{"data_%"}},
+		{"p", 0, Filter{}, 0, []string{"al", "b"}, []string{"alice", "bob"}},
+		{"p", 1, Filter{}, 0, []string{"data"}, []string{"data1", "data2", "data3"}},
+		{"p", 0, Filter{V1: []string{"data2"}}, 0, nil, []string{"bob", "data2_admin"}},
+		{"p", 1, Filter{V0: []string{"data2_admin"}, V2: []string{"read"}}, 0, nil, []string{"data2", "data3"}},
+		{"g", 1, Filter{}, 0, nil, []string{"data2_admin"}},
+		{"", 0, Filter{}, 0, []string{"a"}, []string{"alice"}},
+		{"", 0, Filter{Ptype: []string{"g"}}, 0, nil, []string{"alice"}},
+		{"p", 3, Filter{}, 0, nil, []string{}},
+	}
+
+	for _, tc := range testCases {
+		values, err := a.ListDistinctValues(ctx, tc.ptype, tc.fieldIndex, tc.filter, tc.limit, tc.prefix...)
+		if err != nil {
+			t.Fatalf("ListDistinctValues(%q, %d, %+v, %d, %q) failed, err: %v", tc.ptype, tc.fieldIndex, tc.filter, tc.limit, tc.prefix, err)
+		}
+		if !reflect.DeepEqual(values, tc.want) {
+			t.Errorf("ListDistinctValues(%q, %d, %+v, %d, %q): %v, supposed to be %v", tc.ptype, tc.fieldIndex, tc.filter, tc.limit, tc.prefix, values, tc.want)
+		}
+	}
+
+	if _, err = a.ListDistinctValues(ctx, "p", 6, Filter{}, 0); err == nil {
+		t.Error("ListDistinctValues should reject invalid field indexes")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"fmt"
+	"sort"
+)
+
+// tableFor returns the policy table storing the rules of ptype: the table of the ptype if
+// routed, else the table of its section, the first letter of the ptype, else the default one.
+func (a *Adapter) tableFor(ptype string) string {
+	if table, ok := a.routes[ptype]; ok {
+		return table
+	}
+	if ptype != "" {
+		if table, ok := a.routes[ptype[:1]]; ok {
+			return table
+		}
+	}
+	return a.ruleTableName()
+}
+
+// ruleTables returns the policy tables, the default one first, then the routed ones sorted.
+func (a *Adapter) ruleTables() []string {
+	tables := []string{a.ruleTableName()}
+	seen := map[string]bool{a.ruleTableName(): true}
+	routed := make([]string, 0, len(a.routes))
+	for _, table := range a.routes {
+		if !seen[table] {
+			seen[table] = true
+			routed = append(routed, table)
+		}
+	}
+	sort.Strings(routed)
+	return append(tables, routed...)
+}
+
+// isRuleTable reports whether name is one of the policy tables.
+func (a *Adapter) isRuleTable(name string) bool {
+	if name == a.ruleTableName() {
+		return true
+	}
+	for _, table := range a.routes {
+		if table == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tablesOf returns the policy tables which may store the rules selected by the filter.
+func (a *Adapter) tablesOf(filter Filter) []string {
+	if len(filter.Ptype) == 0 {
+		return a.ruleTables()
+	}
+	selected := make(map[string]bool, len(filter.Ptype))
+	for _, ptype := range filter.Ptype {
+		selected[a.tableFor(ptype)] = true
+	}
+	tables := make([]string, 0, len(selected))
+	for _, table := range a.ruleTables() {
+		if selected[table] {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// checkRoutes checks that the routed ptypes and tables are named.
+func (a *Adapter) checkRoutes() error {
+	for ptype, table := range a.routes {
+		if ptype == "" || table == "" {
+			return fmt.Errorf("invalid route of the ptype %q to the table %q", ptype, table)
+		}
+	}
+	return nil
+}
+
+// groupByTable splits lines by their policy table, in the order of their first rule.
+func groupByTable(lines []*CasbinRule) ([]string, map[string][]*CasbinRule) {
+	tables := make([]string, 0, 1)
+	groups := make(map[string][]*CasbinRule, 1)
+	for _, line := range lines {
+		table := line.TableName()
+		if _, ok := groups[table]; !ok {
+			tables = append(tables, table)
+		}
+		groups[table] = append(groups[table], line)
+	}
+	return tables, groups
+}
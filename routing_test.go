@@ -0,0 +1,150 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+	"xorm.io/xorm"
+)
+
+func TestSQLiteTableRouting(t *testing.T) {
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"),
+		WithTableRouting(map[string]string{"g": "casbin_role"}), WithChangeLog())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+	testFilteredPolicy(t, a)
+	testAddPolicies(t, a)
+	testRemovePolicies(t, a)
+	testUpdatePolicies(t, a)
+	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
+
+	// The grouping rules are only stored in their own table.
+	initPolicy(t, a)
+	ctx := context.Background()
+	for table, ptype := range map[string]string{"casbin_rule": "p", "casbin_role": "g"} {
+		lines := make([]*CasbinRule, 0)
+		if err = a.engine.Table(table).Find(&lines); err != nil {
+			t.Fatalf("failed to read the table %s, err: %v", table, err)
+		}
+		for _, line := range lines {
+			if line.Ptype != ptype {
+				t.Errorf("the table %s has a rule of ptype %s", table, line.Ptype)
+			}
+		}
+		if len(lines) == 0 {
+			t.Errorf("the table %s is empty", table)
+		}
+	}
+
+	if total, err := a.CountPolicies(ctx, Filter{}); err != nil || total != 5 {
+		t.Errorf("CountPolicies = %d, err: %v, supposed to be 5", total, err)
+	}
+	if has, err := a.HasPolicy(ctx, "g", []string{"alice", "data2_admin"}); err != nil || !has {
+		t.Errorf("HasPolicy = %v, err: %v, supposed to be true", has, err)
+	}
+	values, err := a.ListDistinctValues(ctx, "", 0, Filter{}, 0)
+	if err != nil {
+		t.Fatalf("ListDistinctValues failed, err: %v", err)
+	}
+	if !util.ArrayEquals(values, []string{"alice", "bob", "data2_admin"}) {
+		t.Errorf("ListDistinctValues = %v", values)
+	}
+
+	// The pages of several tables are merged.
+	var rows []PolicyRow
+	page := Page{Limit: 2}
+	for {
+		res, err := a.QueryPolicies(ctx, Filter{}, page)
+		if err != nil {
+			t.Fatalf("QueryPolicies failed, err: %v", err)
+		}
+		if res.Total != 5 {
+			t.Errorf("QueryPolicies total = %d, supposed to be 5", res.Total)
+		}
+		rows = append(rows, res.Rows...)
+		if res.NextCursor == "" {
+			break
+		}
+		page.Cursor = res.NextCursor
+	}
+	want := []PolicyRow{
+		{"g", []string{"alice", "data2_admin"}},
+		{"p", []string{"alice", "data1", "read"}},
+		{"p", []string{"bob", "data2", "write"}},
+		{"p", []string{"data2_admin", "data2", "read"}},
+		{"p", []string{"data2_admin", "data2", "write"}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("QueryPolicies = %v, supposed to be %v", rows, want)
+	}
+	res, err := a.QueryPolicies(ctx, Filter{}, Page{Limit: 2, Offset: 1, OrderBy: []string{"-v0"}})
+	if err != nil {
+		t.Fatalf("QueryPolicies failed, err: %v", err)
+	}
+	if want = []PolicyRow{want[4], want[2]}; !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("QueryPolicies = %v, supposed to be %v", res.Rows, want)
+	}
+	res, err = a.QueryPolicies(ctx, Filter{Ptype: []string{"g"}}, Page{})
+	if err != nil || len(res.Rows) != 1 {
+		t.Errorf("QueryPolicies = %+v, err: %v", res, err)
+	}
+
+	// Both tables are covered by the snapshots.
+	if err = a.CreateSnapshot(ctx, "before"); err != nil {
+		t.Fatalf("CreateSnapshot failed, err: %v", err)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if _, err = e.DeleteRoleForUser("alice", "data2_admin"); err != nil {
+		t.Fatalf("DeleteRoleForUser failed, err: %v", err)
+	}
+	if err = a.RestoreSnapshot(ctx, "before"); err != nil {
+		t.Fatalf("RestoreSnapshot failed, err: %v", err)
+	}
+	if has, _ := a.HasPolicy(ctx, "g", []string{"alice", "data2_admin"}); !has {
+		t.Error("the grouping rule should have been restored")
+	}
+
+	if _, err = NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"),
+		WithTableRouting(map[string]string{"g": ""})); err == nil {
+		t.Error("a route without table should be rejected")
+	}
+}
+
+func TestRoutingPaging(t *testing.T) {
+	engine, err := xorm.NewEngine("postgres", "user=postgres password=postgres host=127.0.0.1 port=5432 sslmode=disable dbname=casbin")
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	defer engine.Close()
+
+	// The rules of several tables can't be paged in the order of the database.
+	a := &Adapter{engine: engine, routes: map[string]string{"g": "casbin_role"}}
+	for _, page := range []Page{{Limit: 2}, {Limit: 2, Offset: 1}, {Cursor: "cursor"}} {
+		if _, err = a.QueryPolicies(context.Background(), Filter{}, page); !errors.Is(err, errPagingTables) {
+			t.Errorf("QueryPolicies(%+v) returned err: %v", page, err)
+		}
+	}
+}
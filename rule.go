@@ -0,0 +1,76 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// RuleHook populates the extra columns of a rule of the custom rule type before it is inserted.
+// bean is a pointer to a new value of the custom rule type, whose CasbinRule has been set from
+// rule, and ctx is the context passed to the *Ctx methods.
+type RuleHook func(ctx context.Context, rule *CasbinRule, bean interface{}) error
+
+var casbinRuleType = reflect.TypeOf(CasbinRule{})
+
+// ruleBean returns a bean of the policy table, of the custom rule type if any.
+func (a *Adapter) ruleBean() (interface{}, error) {
+	return a.ruleBeanOf(a.ruleTableName())
+}
+
+// ruleBeanOf returns a bean of the policy table named table, of the custom rule type if any.
+func (a *Adapter) ruleBeanOf(table string) (interface{}, error) {
+	bean, _, err := a.ruleValue(&CasbinRule{tableName: table})
+	return bean, err
+}
+
+// newRuleBean returns the bean to insert for line, of the custom rule type populated
+// by the hook if any, or line itself.
+func (a *Adapter) newRuleBean(ctx context.Context, line *CasbinRule) (interface{}, error) {
+	bean, rule, err := a.ruleValue(line)
+	if err != nil {
+		return nil, err
+	}
+	if a.ruleType != nil && a.ruleHook != nil {
+		if err = a.ruleHook(ctx, rule, bean); err != nil {
+			return nil, err
+		}
+	}
+	return bean, nil
+}
+
+// ruleValue returns a bean of the custom rule type if any, and its CasbinRule set from line,
+// stored in the policy table of line if set, else in the table of its ptype.
+func (a *Adapter) ruleValue(line *CasbinRule) (interface{}, *CasbinRule, error) {
+	rule := *line
+	if rule.tableName == "" {
+		rule.tableName = a.tableFor(rule.Ptype)
+	}
+	if a.ruleType == nil {
+		return &rule, &rule, nil
+	}
+
+	field, ok := a.ruleType.FieldByName("CasbinRule")
+	if a.ruleType.Kind() != reflect.Struct || !ok || !field.Anonymous || len(field.Index) != 1 || field.Type != casbinRuleType {
+		return nil, nil, fmt.Errorf("the rule type %v must embed CasbinRule", a.ruleType)
+	}
+
+	bean := reflect.New(a.ruleType)
+	embedded := bean.Elem().Field(field.Index[0])
+	embedded.Set(reflect.ValueOf(rule))
+	return bean.Interface(), embedded.Addr().Interface().(*CasbinRule), nil
+}
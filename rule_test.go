@@ -0,0 +1,80 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+type tenantRule struct {
+	CasbinRule  `xorm:"extends"`
+	TenantID    string `xorm:"'tenant_id' varchar(100) not null default ''"`
+	CreatedBy   string `xorm:"varchar(100) not null default ''"`
+	Description string `xorm:"text"`
+}
+
+type creatorKey struct{}
+
+func TestRuleType(t *testing.T) {
+	hook := func(ctx context.Context, rule *CasbinRule, bean interface{}) error {
+		r := bean.(*tenantRule)
+		r.TenantID = "tenant1"
+		r.CreatedBy = fmt.Sprint(ctx.Value(creatorKey{}))
+		r.Description = rule.Ptype + " rule of " + rule.V0
+		return nil
+	}
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), WithRuleType(&tenantRule{}, hook))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+
+	ctx := context.WithValue(context.Background(), creatorKey{}, "admin")
+	if err = a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicyCtx failed, err: %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	rules := make([]*tenantRule, 0)
+	if err = a.engine.Table(a.ruleTableName()).Where("v0 = ?", "carol").Find(&rules); err != nil {
+		t.Fatalf("failed to read the rules, err: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("%d rules found, supposed to be 1", len(rules))
+	}
+	if r := rules[0]; r.TenantID != "tenant1" || r.CreatedBy != "admin" || r.Description != "p rule of carol" {
+		t.Errorf("the extra columns are %q, %q, %q", r.TenantID, r.CreatedBy, r.Description)
+	}
+
+	// The rules saved by SavePolicy are populated as well.
+	count, err := a.engine.Table(a.ruleTableName()).Where("tenant_id = ?", "tenant1").Count()
+	if err != nil {
+		t.Fatalf("failed to count the rules, err: %v", err)
+	}
+	if count != 6 {
+		t.Errorf("%d rules have the tenant, supposed to be 6", count)
+	}
+
+	if _, err = NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), WithRuleType(&struct{ Name string }{}, nil)); err == nil {
+		t.Error("a rule type not embedding CasbinRule should be rejected")
+	}
+}
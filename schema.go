@@ -0,0 +1,221 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"xorm.io/xorm/schemas"
+)
+
+// SchemaError is returned by VerifySchema when tables or columns needed by the adapter are missing.
+type SchemaError struct {
+	// MissingTables lists the tables that don't exist.
+	MissingTables []string
+	// MissingColumns lists the missing columns of the existing tables, by table.
+	MissingColumns map[string][]string
+}
+
+func (e *SchemaError) Error() string {
+	problems := make([]string, 0, len(e.MissingTables)+len(e.MissingColumns))
+	for _, table := range e.MissingTables {
+		problems = append(problems, "missing table "+table)
+	}
+	tables := make([]string, 0, len(e.MissingColumns))
+	for table := range e.MissingColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		problems = append(problems, "missing columns of table "+table+": "+strings.Join(e.MissingColumns[table], ", "))
+	}
+	return "the database schema doesn't match the adapter: " + strings.Join(problems, "; ")
+}
+
+// Feature is a feature of the adapter whose tables are created when it is first used,
+// instead of by an option, see WithFeatures.
+type Feature int
+
+const (
+	// FeatureWatcher is the watcher table of NewWatcher.
+	FeatureWatcher Feature = iota
+	// FeatureDispatcher is the dispatcher table of NewDispatcher.
+	FeatureDispatcher
+	// FeatureSnapshots is the tables of the snapshots, see CreateSnapshot.
+	FeatureSnapshots
+)
+
+// uses reports whether feature has been declared with WithFeatures.
+func (a *Adapter) uses(feature Feature) bool {
+	for _, f := range a.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaTable is a table used by the adapter besides the policy table.
+type schemaTable struct {
+	name string
+	bean interface{}
+}
+
+// featureTables returns the tables used by the enabled features on a database of dbType.
+func (a *Adapter) featureTables(dbType schemas.DBType) []schemaTable {
+	tables := make([]schemaTable, 0, 8)
+	if a.changeLog || a.optimistic || a.uses(FeatureWatcher) || a.uses(FeatureDispatcher) {
+		tables = append(tables, schemaTable{a.seqTableName(), &policySeq{tableName: a.seqTableName()}})
+	}
+	if a.versioned() && a.tenantColumn != "" {
+		tables = append(tables, schemaTable{a.tenantSeqTableName(), &tenantSeq{tableName: a.tenantSeqTableName()}})
+	}
+	if a.changeLog {
+		tables = append(tables, schemaTable{a.changeLogTableName(), &ChangeLogEntry{tableName: a.changeLogTableName()}})
+	}
+	if a.audit {
+		tables = append(tables, schemaTable{a.auditTableName(), &AuditRecord{tableName: a.auditTableName()}})
+	}
+	if a.uses(FeatureWatcher) {
+		tables = append(tables, schemaTable{a.watcherTableName(), &watcherRecord{tableName: a.watcherTableName()}})
+	}
+	if a.uses(FeatureDispatcher) {
+		tables = append(tables, schemaTable{a.dispatchTableName(), &dispatchMessage{tableName: a.dispatchTableName()}})
+	}
+	if a.uses(FeatureSnapshots) {
+		tables = append(tables,
+			schemaTable{a.snapshotTableName(), &Snapshot{tableName: a.snapshotTableName()}},
+			schemaTable{a.snapshotRuleTableName(), &snapshotRule{tableName: a.snapshotRuleTableName()}})
+	}
+	switch dbType {
+	case schemas.POSTGRES, schemas.MYSQL:
+	default:
+		// The databases without named locks need the lock table.
+		tableName := a.ruleTableName() + "_lock"
+		tables = append(tables, schemaTable{tableName, &policyLock{tableName: tableName}})
+	}
+	return tables
+}
+
+// expectedTables returns the columns of the tables the adapter writes to, by table.
+func (a *Adapter) expectedTables() (map[string][]string, error) {
+	tables := make(map[string][]string)
+	add := func(name string, bean interface{}) error {
+		table, err := a.engine.TableInfo(bean)
+		if err != nil {
+			return err
+		}
+		tables[name] = table.ColumnsSeq()
+		return nil
+	}
+
+	for _, table := range a.ruleTables() {
+		switch {
+		case a.columns != nil:
+			columns := make([]string, 0, len(a.columns))
+			for _, name := range a.columns {
+				if name != "" {
+					columns = append(columns, name)
+				}
+			}
+			tables[table] = columns
+		case a.existingTable:
+			tables[table] = ruleColumns
+		default:
+			bean, err := a.ruleBeanOf(table)
+			if err != nil {
+				return nil, err
+			}
+			if err = add(table, bean); err != nil {
+				return nil, err
+			}
+		}
+		if a.tenantColumn != "" {
+			declared := false
+			for _, column := range tables[table] {
+				declared = declared || column == a.tenantColumn
+			}
+			// A custom rule type may declare the tenant column.
+			if !declared {
+				tables[table] = append(append([]string{}, tables[table]...), a.tenantColumn)
+			}
+		}
+	}
+
+	for _, table := range a.featureTables(a.engine.Dialect().URI().DBType) {
+		if err := add(table.name, table.bean); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// VerifySchema checks that the tables and the columns used by the adapter with its options
+// exist, without changing anything, and returns a *SchemaError listing the missing ones.
+// It is meant for the schemas managed outside the adapter, see WithoutSchemaSync.
+// The tables of the watcher, the dispatcher and the snapshots are checked when declared
+// with WithFeatures.
+func (a *Adapter) VerifySchema(ctx context.Context) error {
+	expected, err := a.expectedTables()
+	if err != nil {
+		return err
+	}
+
+	dialect := a.engine.Dialect()
+	existing, err := dialect.GetTables(a.engine.DB(), ctx)
+	if err != nil {
+		return err
+	}
+	tableNames := make(map[string]string, len(existing))
+	for _, table := range existing {
+		tableNames[strings.ToLower(table.Name)] = table.Name
+	}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schemaErr := &SchemaError{MissingColumns: make(map[string][]string)}
+	for _, name := range names {
+		tableName, ok := tableNames[strings.ToLower(name)]
+		if !ok {
+			schemaErr.MissingTables = append(schemaErr.MissingTables, name)
+			continue
+		}
+
+		columns, _, err := dialect.GetColumns(a.engine.DB(), ctx, tableName)
+		if err != nil {
+			return err
+		}
+		columnNames := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			columnNames[strings.ToLower(column)] = true
+		}
+		for _, column := range expected[name] {
+			if !columnNames[strings.ToLower(column)] {
+				schemaErr.MissingColumns[name] = append(schemaErr.MissingColumns[name], column)
+			}
+		}
+	}
+
+	if len(schemaErr.MissingTables) > 0 || len(schemaErr.MissingColumns) > 0 {
+		return schemaErr
+	}
+	return nil
+}
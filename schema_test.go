@@ -0,0 +1,114 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestVerifySchema(t *testing.T) {
+	ctx := context.Background()
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithoutSchemaSync())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+
+	var schemaErr *SchemaError
+	if err = a.VerifySchema(ctx); !errors.As(err, &schemaErr) {
+		t.Fatalf("VerifySchema should report the missing tables, err: %v", err)
+	}
+	if !reflect.DeepEqual(schemaErr.MissingTables, []string{"casbin_rule", "casbin_rule_lock"}) {
+		t.Errorf("the missing tables are %v", schemaErr.MissingTables)
+	}
+
+	_, err = a.engine.Exec(`CREATE TABLE casbin_rule (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ptype VARCHAR(100) NOT NULL DEFAULT '',
+		v0 VARCHAR(100) NOT NULL DEFAULT '',
+		v1 VARCHAR(100) NOT NULL DEFAULT '',
+		v2 VARCHAR(100) NOT NULL DEFAULT '',
+		v3 VARCHAR(100) NOT NULL DEFAULT '')`)
+	if err != nil {
+		t.Fatalf("failed to create the table, err: %v", err)
+	}
+	if err = a.VerifySchema(ctx); !errors.As(err, &schemaErr) {
+		t.Fatalf("VerifySchema should report the missing columns, err: %v", err)
+	}
+	if !reflect.DeepEqual(schemaErr.MissingColumns, map[string][]string{"casbin_rule": {"v4", "v5"}}) {
+		t.Errorf("the missing columns are %v", schemaErr.MissingColumns)
+	}
+	if err.Error() != "the database schema doesn't match the adapter: missing table casbin_rule_lock; missing columns of table casbin_rule: v4, v5" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	// Another adapter, allowed to sync, completes the schema.
+	if _, err = a.engine.Exec("DROP TABLE casbin_rule"); err != nil {
+		t.Fatalf("failed to drop the table, err: %v", err)
+	}
+	if _, err = NewAdapter("sqlite3", dataSourceName); err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = a.VerifySchema(ctx); err != nil {
+		t.Fatalf("VerifySchema failed, err: %v", err)
+	}
+
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+	testSaveFilteredPolicy(t, a)
+
+	// The tables of the declared features are created when first used.
+	features, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithoutSchemaSync(),
+		WithFeatures(FeatureWatcher, FeatureDispatcher, FeatureSnapshots))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = features.VerifySchema(ctx); !errors.As(err, &schemaErr) {
+		t.Fatalf("VerifySchema should report the missing tables, err: %v", err)
+	}
+	want := []string{"casbin_rule_dispatch", "casbin_rule_seq", "casbin_rule_snapshot", "casbin_rule_snapshot_rule", "casbin_rule_watcher"}
+	if !reflect.DeepEqual(schemaErr.MissingTables, want) {
+		t.Errorf("the missing tables are %v, supposed to be %v", schemaErr.MissingTables, want)
+	}
+
+	synced, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	w, err := NewWatcher(synced, time.Second)
+	if err != nil {
+		t.Fatalf("NewWatcher failed, err: %v", err)
+	}
+	defer w.Close()
+	e, _ := casbin.NewDistributedEnforcer("examples/rbac_model.conf", synced)
+	d, err := NewDispatcher(synced, e, time.Second)
+	if err != nil {
+		t.Fatalf("NewDispatcher failed, err: %v", err)
+	}
+	defer d.Close()
+	if _, err = synced.ListSnapshots(ctx); err != nil {
+		t.Fatalf("ListSnapshots failed, err: %v", err)
+	}
+	if err = features.VerifySchema(ctx); err != nil {
+		t.Errorf("VerifySchema failed, err: %v", err)
+	}
+}
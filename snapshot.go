@@ -0,0 +1,230 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// Snapshot is a named copy of the policy table.
+type Snapshot struct {
+	Id        int64     `xorm:"pk autoincr"`
+	Name      string    `xorm:"varchar(100) unique not null"`
+	RuleCount int64     `xorm:"not null default 0"`
+	Created   time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the snapshot table.
+func (s *Snapshot) TableName() string {
+	return s.tableName
+}
+
+// snapshotRule is a policy rule stored in a snapshot.
+type snapshotRule struct {
+	SnapshotId int64  `xorm:"index not null"`
+	Ptype      string `xorm:"varchar(100) not null default ''"`
+	V0         string `xorm:"varchar(100) not null default ''"`
+	V1         string `xorm:"varchar(100) not null default ''"`
+	V2         string `xorm:"varchar(100) not null default ''"`
+	V3         string `xorm:"varchar(100) not null default ''"`
+	V4         string `xorm:"varchar(100) not null default ''"`
+	V5         string `xorm:"varchar(100) not null default ''"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the table of the snapshot rules.
+func (r *snapshotRule) TableName() string {
+	return r.tableName
+}
+
+func (a *Adapter) snapshotTableName() string {
+	return a.ruleTableName() + "_snapshot"
+}
+
+func (a *Adapter) snapshotRuleTableName() string {
+	return a.ruleTableName() + "_snapshot_rule"
+}
+
+func (a *Adapter) createSnapshotTables() error {
+	// The snapshots are shared by the tenants.
+	if a.tenantColumn != "" {
+		return errTenantUnsupported("the snapshots")
+	}
+	session := a.engine.NewSession()
+	defer session.Close()
+	return a.sync(session, &Snapshot{tableName: a.snapshotTableName()}, &snapshotRule{tableName: a.snapshotRuleTableName()})
+}
+
+func (a *Adapter) getSnapshot(session *xorm.Session, name string) (*Snapshot, error) {
+	snapshot := &Snapshot{tableName: a.snapshotTableName()}
+	has, err := session.Table(snapshot).Where("name = ?", name).Get(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("snapshot %q does not exist", name)
+	}
+	return snapshot, nil
+}
+
+// CreateSnapshot stores a copy of the current policy under the given name.
+func (a *Adapter) CreateSnapshot(ctx context.Context, name string) error {
+	if err := a.createSnapshotTables(); err != nil {
+		return err
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		return err
+	}
+
+	if err := a.createSnapshot(session, name); err != nil {
+		_ = session.Rollback()
+		return err
+	}
+
+	return session.Commit()
+}
+
+func (a *Adapter) createSnapshot(session *xorm.Session, name string) error {
+	exist, err := session.Table(&Snapshot{tableName: a.snapshotTableName()}).Where("name = ?", name).Exist()
+	if err != nil {
+		return err
+	}
+	if exist {
+		return fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	lines := make([]*CasbinRule, 0, 64)
+	for _, table := range a.ruleTables() {
+		if err = a.rules(session, table, "").Find(&lines); err != nil {
+			return err
+		}
+	}
+
+	snapshot := &Snapshot{Name: name, RuleCount: int64(len(lines)), tableName: a.snapshotTableName()}
+	if _, err = session.InsertOne(snapshot); err != nil {
+		return err
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+	rules := make([]*snapshotRule, 0, len(lines))
+	for _, line := range lines {
+		rules = append(rules, &snapshotRule{
+			SnapshotId: snapshot.Id,
+			Ptype:      line.Ptype,
+			V0:         line.V0,
+			V1:         line.V1,
+			V2:         line.V2,
+			V3:         line.V3,
+			V4:         line.V4,
+			V5:         line.V5,
+			tableName:  a.snapshotRuleTableName(),
+		})
+	}
+	_, err = session.Insert(&rules)
+	return err
+}
+
+// ListSnapshots returns the snapshots of the policy, from the oldest to the newest.
+func (a *Adapter) ListSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	if err := a.createSnapshotTables(); err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0)
+	if err := a.engine.Context(ctx).Table(&Snapshot{tableName: a.snapshotTableName()}).Asc("id").Find(&snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// RestoreSnapshot replaces the policy with the snapshot of the given name, in a single transaction.
+func (a *Adapter) RestoreSnapshot(ctx context.Context, name string) error {
+	if err := a.createSnapshotTables(); err != nil {
+		return err
+	}
+
+	return a.transaction(ctx, func(tx *policyTx) error {
+		snapshot, err := a.getSnapshot(tx.Session, name)
+		if err != nil {
+			return err
+		}
+
+		rules := make([]*snapshotRule, 0, snapshot.RuleCount)
+		err = tx.Table(&snapshotRule{tableName: a.snapshotRuleTableName()}).Where("snapshot_id = ?", snapshot.Id).Find(&rules)
+		if err != nil {
+			return err
+		}
+
+		lines := make([]*CasbinRule, 0, len(rules))
+		for _, rule := range rules {
+			lines = append(lines, &CasbinRule{
+				Ptype:     rule.Ptype,
+				V0:        rule.V0,
+				V1:        rule.V1,
+				V2:        rule.V2,
+				V3:        rule.V3,
+				V4:        rule.V4,
+				V5:        rule.V5,
+				tableName: a.tableFor(rule.Ptype),
+			})
+		}
+
+		if err = tx.deleteFiltered(Filter{}); err != nil {
+			return err
+		}
+		return tx.insert(lines...)
+	})
+}
+
+// DeleteSnapshot deletes the snapshot of the given name.
+func (a *Adapter) DeleteSnapshot(ctx context.Context, name string) error {
+	if err := a.createSnapshotTables(); err != nil {
+		return err
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		return err
+	}
+
+	snapshot, err := a.getSnapshot(session, name)
+	if err == nil {
+		_, err = session.Where("snapshot_id = ?", snapshot.Id).Delete(&snapshotRule{tableName: a.snapshotRuleTableName()})
+	}
+	if err == nil {
+		_, err = session.ID(snapshot.Id).Delete(&Snapshot{tableName: a.snapshotTableName()})
+	}
+	if err != nil {
+		_ = session.Rollback()
+		return err
+	}
+
+	return session.Commit()
+}
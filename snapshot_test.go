@@ -0,0 +1,71 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestSnapshots(t *testing.T) {
+	a := newSQLiteAdapter(t)
+	initPolicy(t, a)
+	ctx := context.Background()
+
+	var err error
+	logErr := func(action string) {
+		if err != nil {
+			t.Fatalf("test action[%s] failed, err: %v", action, err)
+		}
+	}
+
+	err = a.CreateSnapshot(ctx, "before")
+	logErr("CreateSnapshot")
+	if err = a.CreateSnapshot(ctx, "before"); err == nil {
+		t.Error("CreateSnapshot should fail for an existing name")
+	}
+
+	err = a.RemoveFilteredPolicy("p", "p", 1, "data2")
+	logErr("RemoveFilteredPolicy")
+	err = a.AddPolicy("p", "p", []string{"carol", "data3", "read"})
+	logErr("AddPolicy")
+	err = a.CreateSnapshot(ctx, "after")
+	logErr("CreateSnapshot2")
+
+	snapshots, err := a.ListSnapshots(ctx)
+	logErr("ListSnapshots")
+	if len(snapshots) != 2 || snapshots[0].Name != "before" || snapshots[0].RuleCount != 5 || snapshots[1].Name != "after" || snapshots[1].RuleCount != 3 {
+		t.Errorf("unexpected snapshots: %+v, %+v", snapshots[0], snapshots[1])
+	}
+
+	err = a.RestoreSnapshot(ctx, "before")
+	logErr("RestoreSnapshot")
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if !e.HasGroupingPolicy("alice", "data2_admin") {
+		t.Error("the grouping policy should be restored")
+	}
+
+	err = a.DeleteSnapshot(ctx, "before")
+	logErr("DeleteSnapshot")
+	if err = a.RestoreSnapshot(ctx, "before"); err == nil {
+		t.Error("RestoreSnapshot should fail for a deleted snapshot")
+	}
+	err = a.LoadPolicy(e.GetModel())
+	logErr("LoadPolicy")
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultPollInterval = time.Second
+
+// ChangeEvent is a change of the policy, delivered by Subscribe.
+type ChangeEvent struct {
+	// Op is one of ChangeAdd, ChangeRemove, ChangeUpdate and ChangeSave.
+	Op    string
+	Ptype string
+	// OldRule is the removed or updated rule.
+	OldRule []string
+	// NewRule is the added rule or the result of an update.
+	NewRule []string
+	// Remote is true for a change made by another adapter, read from the change log.
+	// Updates made by other adapters are delivered as a removal followed by an addition,
+	// their saves and the start of their history as a single save, after which the policy
+	// is to be reloaded.
+	Remote bool
+}
+
+// subscription queues the events of a subscriber, so that writers never wait for it.
+type subscription struct {
+	// tenant is the tenant whose changes are delivered, all of them if empty.
+	tenant string
+	mu     sync.Mutex
+	queue  []ChangeEvent
+	notify chan struct{}
+}
+
+func (s *subscription) push(events []ChangeEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, events...)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) pop() []ChangeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.queue
+	s.queue = nil
+	return events
+}
+
+// instanceID returns the random identifier of the adapter, used to recognize its own changes.
+func (a *Adapter) instanceID() string {
+	a.instanceOnce.Do(func() {
+		instance := make([]byte, 16)
+		_, _ = rand.Read(instance)
+		a.instance = hex.EncodeToString(instance)
+	})
+	return a.instance
+}
+
+func (a *Adapter) hasSubscribers() bool {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	return len(a.subscribers) > 0
+}
+
+// publish delivers the changes of a committed transaction of tenant to the subscribers.
+func (a *Adapter) publish(tenant string, changes []*policyChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	if len(a.subscribers) == 0 {
+		return
+	}
+
+	events := make([]ChangeEvent, 0, len(changes))
+	for _, change := range changes {
+		if change.auditOnly {
+			continue
+		}
+		events = append(events, ChangeEvent{Op: change.op, Ptype: change.ptype, OldRule: change.oldRule, NewRule: change.newRule})
+	}
+	for sub := range a.subscribers {
+		if sub.tenant != "" && sub.tenant != tenant {
+			continue
+		}
+		sub.push(events)
+	}
+}
+
+// Subscribe returns a channel receiving the changes of the policy made through the adapter,
+// once they have been committed. With the change log enabled, the changes made by other
+// adapters are also polled from it. If the rules are scoped by tenant, only the changes
+// of the tenant of ctx or of the adapter are delivered, or of all the tenants if neither
+// is bound to a tenant. The channel is closed when ctx is done.
+func (a *Adapter) Subscribe(ctx context.Context) <-chan ChangeEvent {
+	// ErrNoTenant leaves the tenant empty, which subscribes to all the tenants.
+	tenant, _ := a.tenant(ctx)
+	sub := &subscription{tenant: tenant, notify: make(chan struct{}, 1)}
+
+	a.subscribersMu.Lock()
+	if a.subscribers == nil {
+		a.subscribers = make(map[*subscription]struct{})
+	}
+	a.subscribers[sub] = struct{}{}
+	a.subscribersMu.Unlock()
+
+	out := make(chan ChangeEvent)
+	go a.serve(ctx, sub, out)
+	return out
+}
+
+func (a *Adapter) serve(ctx context.Context, sub *subscription, out chan<- ChangeEvent) {
+	defer func() {
+		a.subscribersMu.Lock()
+		delete(a.subscribers, sub)
+		a.subscribersMu.Unlock()
+		close(out)
+	}()
+
+	var poll <-chan time.Time
+	var lastSeq int64
+	if a.changeLog {
+		session := a.engine.NewSession().Context(ctx)
+		seq, err := a.currentSeq(session, seqChangeLog)
+		session.Close()
+		if err != nil {
+			log.Printf("read xorm change log sequence failed, err: %v", err)
+		}
+		lastSeq = seq
+
+		interval := a.pollInterval
+		if interval <= 0 {
+			interval = defaultPollInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.notify:
+		case <-poll:
+			seq, err := a.pollChangeLog(ctx, sub, lastSeq)
+			if err != nil {
+				log.Printf("poll xorm change log failed, err: %v", err)
+				continue
+			}
+			lastSeq = seq
+		}
+
+		for _, event := range sub.pop() {
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// pollChangeLog queues the changes made by other adapters since lastSeq,
+// and returns the last sequence number read.
+func (a *Adapter) pollChangeLog(ctx context.Context, sub *subscription, lastSeq int64) (int64, error) {
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	entries := make([]*ChangeLogEntry, 0, 64)
+	err := a.scopeChangeLog(session.Table(&ChangeLogEntry{tableName: a.changeLogTableName()}).
+		Where("seq > ?", lastSeq), sub.tenant).Asc("seq").Find(&entries)
+	if err != nil {
+		return lastSeq, err
+	}
+
+	events := make([]ChangeEvent, 0, len(entries))
+	// The rules recorded after a save or the start of the history are the new policy,
+	// which is delivered as a single save event instead.
+	replacedBy := ""
+	for _, entry := range entries {
+		lastSeq = entry.Seq
+		if replacedBy != "" && entry.Op == ChangeAdd && entry.Instance == replacedBy {
+			continue
+		}
+		replacedBy = ""
+		if entry.Instance == a.instanceID() {
+			continue
+		}
+
+		event := ChangeEvent{Op: entry.Op, Ptype: entry.Ptype, Remote: true}
+		switch entry.Op {
+		case ChangeAdd:
+			event.NewRule = entry.rule()
+		case ChangeRemove:
+			event.OldRule = entry.rule()
+		case ChangeSave, changeHistory:
+			event.Op = ChangeSave
+			event.Ptype = ""
+			replacedBy = entry.Instance
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+
+	if len(events) > 0 {
+		sub.push(events)
+	}
+	return lastSeq, nil
+}
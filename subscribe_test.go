@@ -0,0 +1,109 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func receiveEvent(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change event received")
+	}
+	return ChangeEvent{}
+}
+
+func TestSubscribe(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a1, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithChangeLog(), WithChangeLogPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a2, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithChangeLog())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := a1.Subscribe(ctx)
+
+	if err = a1.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+	event := receiveEvent(t, events)
+	want := ChangeEvent{Op: ChangeAdd, Ptype: "p", NewRule: []string{"carol", "data3", "read"}}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, supposed to be %+v", event, want)
+	}
+
+	if err = a1.UpdatePolicy("p", "p", []string{"carol", "data3", "read"}, []string{"carol", "data3", "write"}); err != nil {
+		t.Fatalf("UpdatePolicy failed, err: %v", err)
+	}
+	event = receiveEvent(t, events)
+	want = ChangeEvent{Op: ChangeUpdate, Ptype: "p", OldRule: []string{"carol", "data3", "read"}, NewRule: []string{"carol", "data3", "write"}}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, supposed to be %+v", event, want)
+	}
+
+	// A change made by another adapter is read from the change log.
+	if err = a2.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("RemovePolicy failed, err: %v", err)
+	}
+	event = receiveEvent(t, events)
+	want = ChangeEvent{Op: ChangeRemove, Ptype: "p", OldRule: []string{"alice", "data1", "read"}, Remote: true}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, supposed to be %+v", event, want)
+	}
+
+	// The start of the history of another adapter is a single save, without the rules recorded with it.
+	if _, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithHistory()); err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	event = receiveEvent(t, events)
+	want = ChangeEvent{Op: ChangeSave, Remote: true}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, supposed to be %+v", event, want)
+	}
+	if err = a2.AddPolicy("p", "p", []string{"dave", "data1", "read"}); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+	event = receiveEvent(t, events)
+	want = ChangeEvent{Op: ChangeAdd, Ptype: "p", NewRule: []string{"dave", "data1", "read"}, Remote: true}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %+v, supposed to be %+v", event, want)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("no more event should be received")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the channel should be closed after the context is done")
+	}
+	if a1.hasSubscribers() {
+		t.Error("the subscription should be removed after the context is done")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"xorm.io/xorm"
+)
+
+// ErrNoTenant is returned when the rules are scoped by tenant, see WithTenantColumn,
+// and neither the adapter nor the context is bound to a tenant.
+var ErrNoTenant = errors.New("no tenant bound to the adapter or the context")
+
+// tenant returns the tenant of the rules read and written with ctx: the value stored under
+// the tenant key in ctx if any, else the tenant of the adapter. It is empty if the rules
+// aren't scoped by tenant.
+func (a *Adapter) tenant(ctx context.Context) (string, error) {
+	if a.tenantColumn == "" {
+		return "", nil
+	}
+	tenant := a.tenantValue
+	if a.tenantKey != nil {
+		if value := ctx.Value(a.tenantKey); value != nil {
+			tenant = fmt.Sprint(value)
+		}
+	}
+	if tenant == "" {
+		return "", ErrNoTenant
+	}
+	return tenant, nil
+}
+
+// scope restricts session to the rules of tenant, if the rules are scoped by tenant.
+func (a *Adapter) scope(session *xorm.Session, tenant string) *xorm.Session {
+	if a.tenantColumn == "" {
+		return session
+	}
+	return session.And(a.engine.Quote(a.tenantColumn)+" = ?", tenant)
+}
+
+// checkTenant checks that the tenant column is distinct from the columns of the fields of the
+// rules, and that the dispatcher and the snapshots, which share their tables between the
+// tenants, aren't enabled.
+func (a *Adapter) checkTenant() error {
+	if a.tenantColumn == "" {
+		return nil
+	}
+	for idx := range ruleColumns {
+		if a.columnName(idx) == a.tenantColumn {
+			return fmt.Errorf("the tenant column %s holds the field %s of the rules", a.tenantColumn, ruleColumns[idx])
+		}
+	}
+	switch {
+	case a.uses(FeatureDispatcher):
+		return errTenantUnsupported("a dispatcher")
+	case a.uses(FeatureSnapshots):
+		return errTenantUnsupported("the snapshots")
+	}
+	return nil
+}
+
+// errTenantUnsupported returns the error of a feature whose tables are shared by the tenants.
+func errTenantUnsupported(feature string) error {
+	return fmt.Errorf("%s can't be used with a tenant column", feature)
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+type tenantKey struct{}
+
+func TestSQLiteTenantColumn(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+
+	// The tenant column is added to the existing table.
+	shared, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = shared.AddPolicy("p", "p", []string{"mallory", "data1", "read"}); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithTenantColumn("tenant", "tenant1"), WithTenantKey(tenantKey{}))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	testSaveLoad(t, a)
+	testAutoSave(t, a)
+	testFilteredPolicy(t, a)
+	testAddPolicies(t, a)
+	testRemovePolicies(t, a)
+	testUpdatePolicies(t, a)
+	testUpdateFilteredPolicies(t, a)
+	testSaveFilteredPolicy(t, a)
+	initPolicy(t, a)
+
+	// The rules of the other tenants are left untouched.
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant2")
+	if err = a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicyCtx failed, err: %v", err)
+	}
+	for tenant, want := range map[string]int64{"": 1, "tenant1": 5, "tenant2": 1} {
+		count, err := a.engine.Table("casbin_rule").Where("tenant = ?", tenant).Count()
+		if err != nil {
+			t.Fatalf("failed to count the rules, err: %v", err)
+		}
+		if count != want {
+			t.Errorf("%d rules of the tenant %q, supposed to be %d", count, tenant, want)
+		}
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if total, err := a.CountPolicies(ctx, Filter{}); err != nil || total != 1 {
+		t.Errorf("CountPolicies = %d, err: %v, supposed to be 1", total, err)
+	}
+	if has, err := a.HasPolicy(ctx, "p", []string{"alice", "data1", "read"}); err != nil || has {
+		t.Errorf("HasPolicy = %v, err: %v, supposed to be false", has, err)
+	}
+	if err = a.RemoveFilteredPolicyCtx(ctx, "p", "p", 0, ""); err != nil {
+		t.Fatalf("RemoveFilteredPolicyCtx failed, err: %v", err)
+	}
+	if total, _ := a.CountPolicies(context.Background(), Filter{}); total != 5 {
+		t.Errorf("CountPolicies = %d, supposed to be 5", total)
+	}
+
+	if err = a.CreateSnapshot(context.Background(), "snapshot"); err == nil {
+		t.Error("CreateSnapshot should fail with a tenant column")
+	}
+
+	unbound, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithTenantColumn("tenant", ""), WithTenantKey(tenantKey{}))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = unbound.AddPolicy("p", "p", []string{"alice", "data1", "read"}); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("AddPolicy without tenant returned err: %v", err)
+	}
+	if has, err := unbound.HasPolicy(ctx, "p", []string{"carol"}); err != nil || has {
+		t.Errorf("HasPolicy = %v, err: %v, supposed to be false", has, err)
+	}
+
+	audited, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithTenantColumn("tenant", ""), WithTenantKey(tenantKey{}), WithAuditLog(nil))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = audited.AddPolicyCtx(ctx, "p", "p", []string{"dave", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicyCtx failed, err: %v", err)
+	}
+	records := make([]*AuditRecord, 0)
+	if err = a.engine.Table(&AuditRecord{tableName: a.auditTableName()}).Find(&records); err != nil {
+		t.Fatalf("failed to find the audit records, err: %v", err)
+	}
+	if len(records) != 1 || records[0].Tenant != "tenant2" {
+		t.Errorf("audit records: %+v, supposed to hold a change of tenant2", records)
+	}
+
+	if _, err = NewAdapterWithOptions("sqlite3", dataSourceName, WithTenantColumn("v0", "tenant1")); err == nil {
+		t.Error("a tenant column holding a field should be rejected")
+	}
+}
+
+func TestSQLiteTenantChangeLog(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName,
+		WithTenantColumn("tenant", "tenant1"), WithTenantKey(tenantKey{}), WithChangeLog(), WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	seq, err := a.LoadPolicyDelta(context.Background(), e.GetModel(), 0)
+	if err != nil {
+		t.Fatalf("LoadPolicyDelta failed, err: %v", err)
+	}
+	version, err := a.PolicyVersion(context.Background())
+	if err != nil {
+		t.Fatalf("PolicyVersion failed, err: %v", err)
+	}
+
+	// The changes of the other tenants are neither applied nor conflicting.
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant2")
+	if err = a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicyCtx failed, err: %v", err)
+	}
+	if v, err := a.PolicyVersion(context.Background()); err != nil || v != version {
+		t.Errorf("PolicyVersion = %s, err: %v, supposed to be %s", v, err, version)
+	}
+	other, err := NewAdapterWithOptions("sqlite3", dataSourceName,
+		WithTenantColumn("tenant", "tenant1"), WithTenantKey(tenantKey{}), WithChangeLog(), WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	if err = other.AddPolicy("p", "p", []string{"dave", "data1", "read"}); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+
+	if seq, err = a.LoadPolicyDelta(context.Background(), e.GetModel(), seq); err != nil {
+		t.Fatalf("LoadPolicyDelta failed, err: %v", err)
+	}
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"dave", "data1", "read"}})
+	if err = a.SavePolicy(e.GetModel()); !errors.Is(err, ErrPolicyConflict) {
+		t.Errorf("SavePolicy returned err: %v, supposed to be a conflict with the change of tenant1", err)
+	}
+
+	// The adapter of tenant2 only sees its own change.
+	m := e.GetModel().Copy()
+	m.ClearPolicy()
+	if _, err = a.LoadPolicyDelta(ctx, m, 0); err != nil {
+		t.Fatalf("LoadPolicyDelta failed, err: %v", err)
+	}
+	if rules := m.GetPolicy("p", "p"); len(rules) != 1 || rules[0][0] != "carol" {
+		t.Errorf("the policy of tenant2 is %v, supposed to hold the rule of carol", rules)
+	}
+	if err = a.SavePolicyCtx(ctx, m); err != nil {
+		t.Errorf("SavePolicyCtx failed, err: %v", err)
+	}
+
+	entries := make([]*ChangeLogEntry, 0)
+	if err = a.engine.Table(a.changeLogTableName()).Where("seq > ?", seq).Find(&entries); err != nil {
+		t.Fatalf("failed to read the change log, err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Tenant != "tenant2" || entries[0].Op != ChangeSave {
+		t.Errorf("the change log since %d is %+v, supposed to hold the save of tenant2", seq, entries)
+	}
+}
+
+func TestSQLiteTenantRuleType(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	hook := func(ctx context.Context, rule *CasbinRule, bean interface{}) error {
+		bean.(*tenantRule).CreatedBy = "admin"
+		return nil
+	}
+	a, err := NewAdapterWithOptions("sqlite3", dataSourceName,
+		WithTenantColumn("tenant_id", "tenant1"), WithTenantKey(tenantKey{}), WithRuleType(&tenantRule{}, hook))
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant2")
+	if err = a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("AddPolicyCtx failed, err: %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicyWithoutOrder(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	rules := make([]*tenantRule, 0)
+	if err = a.engine.Table(a.ruleTableName()).Where("v0 = ?", "carol").Find(&rules); err != nil {
+		t.Fatalf("failed to read the rules, err: %v", err)
+	}
+	if len(rules) != 1 || rules[0].TenantID != "tenant2" || rules[0].CreatedBy != "admin" {
+		t.Errorf("the rules of carol are %+v, supposed to be of tenant2 and created by admin", rules)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/core"
+	"xorm.io/xorm/dialects"
+	"xorm.io/xorm/schemas"
+)
+
+const (
+	// defaultColumnSize is the size of the columns of the fields of the rules, VARCHAR(100).
+	defaultColumnSize = 100
+	// defaultIndexPrefix is the length of the prefix of the TEXT columns indexed on MySQL.
+	defaultIndexPrefix = 100
+)
+
+// ErrValueTooLong is returned when a value of a rule is longer than its column allows.
+var ErrValueTooLong = errors.New("value too long for its column")
+
+// ColumnType is the type of a column holding a field of the rules, see WithColumnType.
+type ColumnType struct {
+	// Size is the maximum number of characters of the values, 100 by default.
+	// The column is a VARCHAR(Size), unless Text is set.
+	Size int
+	// Text makes the column a TEXT, whose values are only limited by Size if set.
+	Text bool
+	// IndexPrefix indexes only the first IndexPrefix characters of the column on MySQL,
+	// which keeps the index of long columns within the limits of InnoDB.
+	// The TEXT columns are indexed with a prefix of 100 characters by default.
+	IndexPrefix int
+}
+
+// columnType returns the configured type of the field at idx if any, -1 meaning no field.
+func (a *Adapter) columnType(idx int) (ColumnType, bool) {
+	if idx < 0 {
+		return ColumnType{}, false
+	}
+	t, ok := a.columnTypes[ruleColumns[idx]]
+	return t, ok
+}
+
+// checkSchemaOptions checks that the column types and the indexes are set for the fields of
+// the rules, that the routes name their tables and that the tenant column can be used.
+func (a *Adapter) checkSchemaOptions() error {
+	if err := a.checkRoutes(); err != nil {
+		return err
+	}
+	if err := a.checkTenant(); err != nil {
+		return err
+	}
+	if err := a.checkIndexes(); err != nil {
+		return err
+	}
+	for field, t := range a.columnTypes {
+		if a.fieldIndex(field) < 0 {
+			return fmt.Errorf("the column type of the unknown field %q, supposed to be one of %v", field, ruleColumns)
+		}
+		if t.Size < 0 || t.IndexPrefix < 0 {
+			return fmt.Errorf("the column type of the field %s has a negative size", field)
+		}
+	}
+	return nil
+}
+
+// columnSize returns the maximum number of characters of the field at idx, 0 if unlimited.
+// The columns of existing tables and the columns of SQLite are only limited when configured.
+func (a *Adapter) columnSize(idx int) int {
+	if t, ok := a.columnType(idx); ok {
+		if t.Size > 0 || t.Text {
+			return t.Size
+		}
+		return defaultColumnSize
+	}
+	if a.existingTable || a.engine.Dialect().URI().DBType == schemas.SQLITE {
+		return 0
+	}
+	return defaultColumnSize
+}
+
+// checkValues returns ErrValueTooLong if a value of line is longer than its configured column
+// type allows, instead of letting the database truncate or reject it.
+func (a *Adapter) checkValues(line *CasbinRule) error {
+	for idx, v := range line.values() {
+		size := a.columnSize(idx)
+		if size == 0 || len(v) <= size {
+			continue
+		}
+		if n := utf8.RuneCountInString(v); n > size {
+			return fmt.Errorf("%w: the field %s of %v has %d characters, the column holds %d",
+				ErrValueTooLong, ruleColumns[idx], line.toStringPolicy(), n, size)
+		}
+	}
+	return nil
+}
+
+// buildTable returns a copy of table, parsed from a bean, with the configured types of the
+// columns of the fields of the rules, and the prefixes of the columns to index on MySQL.
+// If rule, table is the policy table: its columns are named after the mapped columns, only
+// columns value columns are kept, the tenant column is added if any and its indexes follow the
+// index strategy, starting with the tenant column.
+func (a *Adapter) buildTable(table *schemas.Table, columns int, rule bool) (*schemas.Table, map[string]int, error) {
+	if rule && a.columns != nil && len(a.columns) < columns+1 {
+		return nil, nil, fmt.Errorf("%d columns are mapped, %d needed for %d value columns", len(a.columns), columns+1, columns)
+	}
+
+	result := schemas.NewEmptyTable()
+	result.Name = table.Name
+	result.StoreEngine = table.StoreEngine
+	if a.storeEngine != "" {
+		result.StoreEngine = a.storeEngine
+	}
+	result.Charset = table.Charset
+	if a.charset != "" {
+		result.Charset = a.charset
+	}
+	result.Comment = table.Comment
+
+	renames := make(map[string]string, len(table.ColumnsSeq()))
+	prefixes := make(map[string]int)
+	for _, col := range table.Columns() {
+		column := *col
+		idx := a.fieldIndex(col.Name)
+		if idx >= 0 && rule {
+			if idx > columns {
+				continue
+			}
+			column.Name = a.columnName(idx)
+		}
+		if t, ok := a.columnType(idx); ok {
+			prefix := t.IndexPrefix
+			if t.Text {
+				column.SQLType = schemas.SQLType{Name: schemas.Text}
+				column.Length = 0
+				// MySQL doesn't allow a default value for TEXT columns.
+				column.Default = ""
+				column.DefaultIsEmpty = true
+				if prefix == 0 {
+					prefix = defaultIndexPrefix
+				}
+			} else {
+				size := t.Size
+				if size == 0 {
+					size = defaultColumnSize
+				}
+				column.SQLType = schemas.SQLType{Name: schemas.Varchar, DefaultLength: int64(size)}
+				column.Length = int64(size)
+			}
+			if prefix > 0 {
+				prefixes[column.Name] = prefix
+			}
+		}
+		renames[col.Name] = column.Name
+		result.AddColumn(&column)
+	}
+	tenant := rule && a.tenantColumn != ""
+	if tenant && result.GetColumn(a.tenantColumn) == nil {
+		// The tenant column is declared like the ptype column of CasbinRule,
+		// unless declared by the custom rule type.
+		column := *table.GetColumn(ruleColumns[0])
+		column.Name = a.tenantColumn
+		column.FieldName = ""
+		result.AddColumn(&column)
+	}
+
+	indexes := table.Indexes
+	if strategyIndexes, ok := a.ruleIndexes(); ok && rule {
+		indexes = strategyIndexes
+	}
+	for _, index := range indexes {
+		idx := schemas.NewIndex(index.Name, index.Type)
+		idx.IsRegular = index.IsRegular
+		if tenant {
+			idx.AddColumn(a.tenantColumn)
+		}
+		for _, col := range index.Cols {
+			if renames[col] != "" {
+				idx.AddColumn(renames[col])
+			}
+		}
+		if len(idx.Cols) > 0 {
+			result.AddIndex(idx)
+		}
+	}
+	return result, prefixes, nil
+}
+
+// createTableStmts returns the statements creating table and its indexes, the same way as Sync2.
+func (a *Adapter) createTableStmts(dialect dialects.Dialect, table *schemas.Table, tableName string, prefixes map[string]int) ([]string, error) {
+	createTable, _, err := dialect.CreateTableSQL(context.Background(), nil, table, tableName)
+	if err != nil {
+		return nil, err
+	}
+	// Postgres ends the statement with a separator, for the comments of the columns.
+	createTable = strings.TrimRight(createTable, "; ")
+	if dialect.URI().DBType == schemas.MSSQL {
+		// The existence check of the table compares its name with the quoted one.
+		quoted := dialect.Quoter().Quote(tableName)
+		createTable = strings.Replace(createTable, "'"+quoted+"'", "'"+tableName+"'", 1)
+	}
+	if a.collation != "" && dialect.URI().DBType == schemas.MYSQL {
+		createTable += " COLLATE " + a.collation
+	}
+	stmts := []string{createTable}
+
+	// Unlike the table, the indexes are created in the schema only if qualified.
+	qualified := dialects.TableNameWithSchema(dialect, tableName)
+	indexNames := make([]string, 0, len(table.Indexes))
+	for name := range table.Indexes {
+		indexNames = append(indexNames, name)
+	}
+	sort.Strings(indexNames)
+	for _, name := range indexNames {
+		stmts = append(stmts, a.createIndexSQL(dialect, qualified, table.Indexes[name], prefixes))
+	}
+	return stmts, nil
+}
+
+// createIndexSQL returns the statement creating index, with the prefixes of its columns on MySQL.
+func (a *Adapter) createIndexSQL(dialect dialects.Dialect, tableName string, index *schemas.Index, prefixes map[string]int) string {
+	if dialect.URI().DBType != schemas.MYSQL || len(prefixes) == 0 {
+		return dialect.CreateIndexSQL(tableName, index)
+	}
+
+	quoter := dialect.Quoter()
+	cols := make([]string, 0, len(index.Cols))
+	for _, col := range index.Cols {
+		if prefix := prefixes[col]; prefix > 0 {
+			cols = append(cols, fmt.Sprintf("%s(%d)", quoter.Quote(col), prefix))
+		} else {
+			cols = append(cols, quoter.Quote(col))
+		}
+	}
+	unique := ""
+	if index.Type == schemas.UniqueType {
+		unique = " UNIQUE"
+	}
+	return fmt.Sprintf("CREATE%s INDEX %s ON %s (%s)", unique, quoter.Quote(index.XName(tableName)), quoter.Quote(tableName), strings.Join(cols, ","))
+}
+
+// syncTyped creates the table of bean with the configured column types and indexes if not
+// existed, or adds its missing columns. Unlike Sync2, the types of the existing columns and
+// the indexes are kept, WidenColumnsMigration and IndexMigration change them.
+func (a *Adapter) syncTyped(session *xorm.Session, bean interface{}) error {
+	info, err := a.engine.TableInfo(bean)
+	if err != nil {
+		return err
+	}
+	tableName := a.engine.TableName(bean)
+	table, prefixes, err := a.buildTable(info, len(ruleColumns)-1, a.isRuleTable(tableName))
+	if err != nil {
+		return err
+	}
+
+	exist, err := session.IsTableExist(tableName)
+	if err != nil {
+		return err
+	}
+	dialect := a.engine.Dialect()
+	if !exist {
+		stmts, err := a.createTableStmts(dialect, table, tableName, prefixes)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			if _, err = session.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	columns, _, err := dialect.GetColumns(queryer(session), context.Background(), tableName)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(columns))
+	for _, name := range columns {
+		existing[strings.ToLower(name)] = true
+	}
+	for _, col := range table.Columns() {
+		if !existing[strings.ToLower(col.Name)] {
+			if _, err = session.Exec(dialect.AddColumnSQL(tableName, col)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queryer returns the transaction of session if any, or its DB.
+func queryer(session *xorm.Session) core.Queryer {
+	if tx := session.Tx(); tx != nil {
+		return tx
+	}
+	return session.DB()
+}
+
+func (a *Adapter) hasMySQLTableOptions() bool {
+	return a.charset != "" || a.collation != "" || a.storeEngine != ""
+}
+
+// customSync reports whether the table of bean is created by syncTyped instead of Sync2, which
+// is the case of the tables with a column of a configured type, of the policy tables with an
+// index strategy, whose indexes Sync2 would drop, or with a tenant column, which the bean lacks,
+// and of all the tables with MySQL table options.
+func (a *Adapter) customSync(bean interface{}) (bool, error) {
+	if a.hasMySQLTableOptions() && a.engine.Dialect().URI().DBType == schemas.MYSQL {
+		return true, nil
+	}
+	if a.tenantColumn != "" && a.isRuleTable(a.engine.TableName(bean)) {
+		return true, nil
+	}
+	if _, ok := a.ruleIndexes(); ok && a.isRuleTable(a.engine.TableName(bean)) {
+		return true, nil
+	}
+	if len(a.columnTypes) == 0 {
+		return false, nil
+	}
+	table, err := a.engine.TableInfo(bean)
+	if err != nil {
+		return false, err
+	}
+	for field := range a.columnTypes {
+		if table.GetColumn(field) != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
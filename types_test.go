@@ -0,0 +1,100 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	"xorm.io/xorm"
+)
+
+func TestColumnType(t *testing.T) {
+	opts := []Option{
+		WithColumnType("v1", ColumnType{Size: 300}),
+		WithColumnType("v2", ColumnType{Text: true}),
+		WithChangeLog(),
+	}
+	a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), opts...)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a)
+	testSaveLoad(t, a)
+	if exist, err := a.engine.SQL("SELECT name FROM sqlite_master WHERE type = 'index' AND name = 'IDX_casbin_rule_EXISTS'").Exist(); err != nil || !exist {
+		t.Errorf("the index of the policy table hasn't been created, err: %v", err)
+	}
+
+	urn := "urn:example:" + strings.Repeat("x", 288)
+	if err = a.AddPolicy("p", "p", []string{"alice", urn, strings.Repeat("r", 1000)}); err != nil {
+		t.Fatalf("AddPolicy failed with a value fitting its column, err: %v", err)
+	}
+	if err = a.AddPolicy("p", "p", []string{"alice", urn + "y", "read"}); !errors.Is(err, ErrValueTooLong) {
+		t.Errorf("AddPolicy should fail with ErrValueTooLong, err: %v", err)
+	}
+	if err = a.UpdatePolicy("p", "p", []string{"alice", "data1", "read"}, []string{"alice", urn + "y", "read"}); !errors.Is(err, ErrValueTooLong) {
+		t.Errorf("UpdatePolicy should fail with ErrValueTooLong, err: %v", err)
+	}
+	// The columns without a configured type aren't limited on SQLite.
+	if err = a.AddPolicy("p", "p", []string{strings.Repeat("a", 200), "data1", "read"}); err != nil {
+		t.Errorf("AddPolicy failed, err: %v", err)
+	}
+	engine, err := xorm.NewEngine("mysql", "root:@tcp(127.0.0.1:3306)/casbin")
+	if err != nil {
+		t.Fatalf("failed to create engine, err: %v", err)
+	}
+	defer engine.Close()
+	mysql := &Adapter{engine: engine, columnTypes: map[string]ColumnType{"v1": {Size: 300}}}
+	if size := mysql.columnSize(1); size != defaultColumnSize {
+		t.Errorf("the column of v0 is limited to %d characters, supposed to be %d", size, defaultColumnSize)
+	}
+	// The columns of the existing tables are only limited when configured.
+	mysql.existingTable = true
+	if size := mysql.columnSize(1); size != 0 {
+		t.Errorf("the column of v0 of an existing table is limited to %d characters", size)
+	}
+	if size := mysql.columnSize(2); size != 300 {
+		t.Errorf("the column of v1 of an existing table is limited to %d characters, supposed to be 300", size)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if !e.HasPolicy("alice", urn, strings.Repeat("r", 1000)) {
+		t.Error("the rule with long values hasn't been loaded")
+	}
+
+	// The generated statements use the column types, with prefix indexes on MySQL.
+	stmts, err := GenerateDDL("mysql", 6, opts...)
+	if err != nil {
+		t.Fatalf("GenerateDDL failed, err: %v", err)
+	}
+	ddl := FormatDDL(stmts)
+	for _, expected := range []string{
+		"`v1` VARCHAR(300) DEFAULT '' NOT NULL",
+		"`v2` TEXT",
+		"(`ptype`,`v0`,`v1`,`v2`(100),`v3`,`v4`,`v5`)",
+		"`casbin_rule_changelog` (`seq` BIGINT(20) PRIMARY KEY NOT NULL, `op` VARCHAR(16) DEFAULT '' NOT NULL, `ptype` VARCHAR(100) DEFAULT '' NOT NULL, `v0` VARCHAR(100) DEFAULT '' NOT NULL, `v1` VARCHAR(300)",
+	} {
+		if !strings.Contains(ddl, expected) {
+			t.Errorf("%q not found in %s", expected, ddl)
+		}
+	}
+
+	if _, err = NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), WithColumnType("v6", ColumnType{Size: 10})); err == nil {
+		t.Error("the type of an unknown field should be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+// ErrPolicyConflict is returned by SavePolicy when the policy has been changed
+// by another adapter since it was loaded.
+var ErrPolicyConflict = errors.New("the policy has been changed since it was loaded")
+
+// readVersion returns the version of the policy of tenant, or 0 without WithOptimisticLocking.
+func (a *Adapter) readVersion(ctx context.Context, tenant string) (int64, error) {
+	if !a.optimistic {
+		return 0, nil
+	}
+
+	session := a.engine.NewSession().Context(ctx)
+	defer session.Close()
+
+	return a.currentVersion(session, tenant)
+}
+
+// ForceSavePolicy saves policy to database, even if it has been changed since it was loaded.
+func (a *Adapter) ForceSavePolicy(model model.Model) error {
+	return a.ForceSavePolicyCtx(context.Background(), model)
+}
+
+// ForceSavePolicyCtx saves policy to database, even if it has been changed since it was loaded.
+func (a *Adapter) ForceSavePolicyCtx(ctx context.Context, model model.Model) error {
+	return a.savePolicy(ctx, model, true)
+}
+
+// PolicyVersion returns a fingerprint of the policy table, which changes whenever the policy
+// changes, so that callers can skip reloading an unchanged policy. With WithOptimisticLocking
+// or WithChangeLog, it is read from the counter maintained by the writes, which only reflects
+// the changes made through the adapters. Otherwise it is a checksum of the rules, which costs
+// a scan of the table but no loading into a model. If the rules are scoped by tenant, it is
+// the version of the policy of the tenant.
+func (a *Adapter) PolicyVersion(ctx context.Context) (string, error) {
+	tenant, err := a.tenant(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if a.optimistic || a.changeLog {
+		session := a.engine.NewSession().Context(ctx)
+		defer session.Close()
+
+		if a.versioned() {
+			version, err := a.currentVersion(session, tenant)
+			if err != nil {
+				return "", err
+			}
+			return "v" + strconv.FormatInt(version, 10), nil
+		}
+		seq, err := a.currentSeq(session, seqChangeLog)
+		if err != nil {
+			return "", err
+		}
+		return "s" + strconv.FormatInt(seq, 10), nil
+	}
+
+	orders := make([]string, 0, len(ruleColumns))
+	for idx := range ruleColumns {
+		if a.columnName(idx) != "" {
+			orders = append(orders, a.columnExpr(idx))
+		}
+	}
+	hash := sha256.New()
+	for _, table := range a.ruleTables() {
+		if err = a.hashRules(ctx, hash, table, tenant, strings.Join(orders, ", ")); err != nil {
+			return "", err
+		}
+	}
+	return "c" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashRules writes the rules of tenant of the policy table named table to h, in the given order.
+func (a *Adapter) hashRules(ctx context.Context, h hash.Hash, table string, tenant string, order string) error {
+	rows, err := a.rules(a.engine.Context(ctx), table, tenant).OrderBy(order).Rows(&CasbinRule{})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		line := &CasbinRule{}
+		if err = rows.Scan(line); err != nil {
+			return err
+		}
+		for _, v := range line.values() {
+			// The length prefix keeps the boundaries of the values.
+			h.Write([]byte(strconv.Itoa(len(v)) + ":" + v))
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestOptimisticLocking(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a1, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a2, err := NewAdapterWithOptions("sqlite3", dataSourceName, WithOptimisticLocking())
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+
+	file, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err = a1.ForceSavePolicy(file.GetModel()); err != nil {
+		t.Fatalf("ForceSavePolicy failed, err: %v", err)
+	}
+
+	e1, _ := casbin.NewEnforcer("examples/rbac_model.conf", a1)
+	e2, _ := casbin.NewEnforcer("examples/rbac_model.conf", a2)
+
+	// The changes made through the same adapter don't conflict.
+	if _, err = e2.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+	if err = e2.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy failed, err: %v", err)
+	}
+
+	// e1 has loaded the policy before the changes of e2.
+	e1.GetModel().AddPolicy("p", "p", []string{"dave", "data1", "read"})
+	if err = e1.SavePolicy(); !errors.Is(err, ErrPolicyConflict) {
+		t.Fatalf("SavePolicy should fail with a conflict, err: %v", err)
+	}
+	e3, _ := casbin.NewEnforcer("examples/rbac_model.conf", a2.ForEnforcer())
+	testGetPolicyWithoutOrder(t, e3, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	if err = a1.ForceSavePolicy(e1.GetModel()); err != nil {
+		t.Fatalf("ForceSavePolicy failed, err: %v", err)
+	}
+	if err = e1.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy after a forced save failed, err: %v", err)
+	}
+	if err = e2.SavePolicy(); !errors.Is(err, ErrPolicyConflict) {
+		t.Fatalf("SavePolicy should fail with a conflict, err: %v", err)
+	}
+
+	// Reloading the policy resolves the conflict.
+	if err = e2.LoadPolicy(); err != nil {
+		t.Fatalf("LoadPolicy failed, err: %v", err)
+	}
+	if err = e2.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy after a reload failed, err: %v", err)
+	}
+	testGetPolicyWithoutOrder(t, e2, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"dave", "data1", "read"}})
+
+	// The enforcers sharing an adapter through ForEnforcer don't take each other's changes as theirs.
+	e4, _ := casbin.NewEnforcer("examples/rbac_model.conf", a2.ForEnforcer())
+	e5, _ := casbin.NewEnforcer("examples/rbac_model.conf", a2.ForEnforcer())
+	if _, err = e5.AddPolicy("erin", "data1", "read"); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+	if err = e4.SavePolicy(); !errors.Is(err, ErrPolicyConflict) {
+		t.Fatalf("SavePolicy should fail with a conflict, err: %v", err)
+	}
+	if err = e5.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy failed, err: %v", err)
+	}
+	filtered := a2.ForEnforcer()
+	e6, _ := casbin.NewEnforcer("examples/rbac_model.conf", filtered)
+	if err = e6.LoadFilteredPolicy(Filter{V0: []string{"alice"}}); err != nil {
+		t.Fatalf("LoadFilteredPolicy failed, err: %v", err)
+	}
+	if !filtered.IsFiltered() || a2.IsFiltered() {
+		t.Error("the filter should only be recorded by the adapter of the enforcer")
+	}
+
+	// The enforcers sharing an adapter without ForEnforcer can't save within each other's load.
+	e7, _ := casbin.NewEnforcer("examples/rbac_model.conf", filtered)
+	if err = e7.LoadFilteredPolicy(Filter{V0: []string{"bob"}}); err != nil {
+		t.Fatalf("LoadFilteredPolicy failed, err: %v", err)
+	}
+	if err = filtered.SaveFilteredPolicy(e6.GetModel()); !errors.Is(err, ErrSharedAdapter) {
+		t.Errorf("SaveFilteredPolicy should fail with ErrSharedAdapter, err: %v", err)
+	}
+	if err = filtered.SavePolicy(e6.GetModel()); !errors.Is(err, ErrSharedAdapter) {
+		t.Errorf("SavePolicy should fail with ErrSharedAdapter, err: %v", err)
+	}
+	if err = filtered.SaveFilteredPolicy(e7.GetModel()); err != nil {
+		t.Errorf("SaveFilteredPolicy failed, err: %v", err)
+	}
+}
+
+func TestPolicyVersion(t *testing.T) {
+	ctx := context.Background()
+	for _, opts := range [][]Option{nil, {WithChangeLog()}, {WithOptimisticLocking()}} {
+		a, err := NewAdapterWithOptions("sqlite3", filepath.Join(t.TempDir(), "casbin.db"), opts...)
+		if err != nil {
+			t.Fatalf("failed to create adapter, err: %v", err)
+		}
+		file, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+		if err = a.ForceSavePolicy(file.GetModel()); err != nil {
+			t.Fatalf("ForceSavePolicy failed, err: %v", err)
+		}
+
+		v1, err := a.PolicyVersion(ctx)
+		if err != nil {
+			t.Fatalf("PolicyVersion failed, err: %v", err)
+		}
+		v2, _ := a.PolicyVersion(ctx)
+		if v1 != v2 {
+			t.Errorf("the version %q should be unchanged without changes, supposed to be %q", v2, v1)
+		}
+
+		if err = a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+			t.Fatalf("AddPolicy failed, err: %v", err)
+		}
+		v3, _ := a.PolicyVersion(ctx)
+		if v3 == v1 {
+			t.Errorf("the version %q should change after a change of the policy", v3)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"xorm.io/xorm"
+)
+
+// watcherRetention is the number of change records kept in the watcher table.
+const watcherRetention = 1000
+
+// watcherRecord is a change notification stored in the watcher table.
+type watcherRecord struct {
+	Id int64 `xorm:"pk autoincr"`
+	// Seq numbers the records in the order of the commits, unlike Id which is assigned
+	// at the insert, so that the polls don't skip the records committed late.
+	Seq      int64     `xorm:"index not null default 0"`
+	Instance string    `xorm:"varchar(64) not null default ''"`
+	Created  time.Time `xorm:"created"`
+
+	tableName string `xorm:"-"`
+}
+
+// TableName returns the name of the watcher table.
+func (r *watcherRecord) TableName() string {
+	return r.tableName
+}
+
+// Watcher is a persist.Watcher polling a companion table of the policy table.
+// Every write performed through its adapter records a change in that table,
+// and the update callback is called when changes recorded by other instances are found.
+type Watcher struct {
+	adapter   *Adapter
+	engine    *xorm.Engine
+	tableName string
+	instance  string
+	interval  time.Duration
+
+	mu       sync.Mutex
+	callback func(string)
+	lastSeq  int64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ persist.WatcherEx = &Watcher{}
+var _ persist.UpdatableWatcher = &Watcher{}
+
+// NewWatcher creates a watcher for the policy table of the adapter, which polls
+// for changes at the given interval. The watcher table is named after the policy
+// table with a "_watcher" suffix and is created if it doesn't exist.
+func NewWatcher(a *Adapter, interval time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, errors.New("invalid parameter: interval")
+	}
+
+	instance := make([]byte, 16)
+	if _, err := rand.Read(instance); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		adapter:   a,
+		engine:    a.engine,
+		tableName: a.watcherTableName(),
+		instance:  hex.EncodeToString(instance),
+		interval:  interval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err := a.changeSchema(func(session *xorm.Session) error {
+		if err := a.createSeqTable(session); err != nil {
+			return err
+		}
+		return a.sync(session, w.bean())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lastSeq, err := w.latestSeq(w.engine.NewSession())
+	if err != nil {
+		return nil, err
+	}
+	w.lastSeq = lastSeq
+
+	a.watcherMu.Lock()
+	a.watcher = w
+	a.watcherMu.Unlock()
+	go w.run()
+
+	return w, nil
+}
+
+func (a *Adapter) watcherTableName() string {
+	return a.ruleTableName() + "_watcher"
+}
+
+func (w *Watcher) bean() *watcherRecord {
+	return &watcherRecord{tableName: w.tableName}
+}
+
+func (w *Watcher) latestSeq(session *xorm.Session) (int64, error) {
+	defer session.Close()
+
+	var records []*watcherRecord
+	if err := session.Table(w.bean()).Desc("seq").Limit(1).Find(&records); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	return records[0].Seq, nil
+}
+
+// record stores a change made by this instance in the watcher table.
+func (w *Watcher) record(session *xorm.Session) error {
+	seq, err := w.adapter.nextSeq(session, seqWatcher, 1)
+	if err != nil {
+		return err
+	}
+	record := &watcherRecord{Seq: seq, Instance: w.instance, tableName: w.tableName}
+	if _, err = session.InsertOne(record); err != nil {
+		return err
+	}
+
+	if seq > watcherRetention {
+		_, err = session.Where("seq <= ?", seq-watcherRetention).Delete(w.bean())
+		return err
+	}
+	return nil
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				log.Printf("poll xorm watcher table failed, err: %v", err)
+			}
+		}
+	}
+}
+
+// poll checks the watcher table for changes recorded by other instances
+// since the last poll, and calls the update callback if there are any.
+func (w *Watcher) poll() error {
+	w.mu.Lock()
+	lastSeq := w.lastSeq
+	w.mu.Unlock()
+
+	var records []*watcherRecord
+	if err := w.engine.Table(w.bean()).Where("seq >= ?", lastSeq).Asc("seq").Find(&records); err != nil {
+		return err
+	}
+
+	// If the last seen record has been pruned, the changes made since then are unknown.
+	changed := lastSeq > 0 && (len(records) == 0 || records[0].Seq != lastSeq)
+	for _, record := range records {
+		if record.Seq > lastSeq && record.Instance != w.instance {
+			changed = true
+		}
+		if record.Seq > lastSeq {
+			lastSeq = record.Seq
+		}
+	}
+
+	w.mu.Lock()
+	w.lastSeq = lastSeq
+	callback := w.callback
+	w.mu.Unlock()
+
+	if changed && callback != nil {
+		callback(strconv.FormatInt(lastSeq, 10))
+	}
+	return nil
+}
+
+// SetUpdateCallback sets the callback function that the watcher will call
+// when the policy in DB has been changed by other instances.
+func (w *Watcher) SetUpdateCallback(callback func(string)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.callback = callback
+	return nil
+}
+
+// Update records a change in the watcher table, so that the other instances reload their policy.
+// Changes made through the adapter are recorded automatically, this is only needed
+// after modifying the policy table by other means.
+func (w *Watcher) Update() error {
+	session := w.engine.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if err := w.record(session); err != nil {
+		_ = session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+// UpdateForAddPolicy does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForAddPolicy(sec, ptype string, params ...string) error {
+	return nil
+}
+
+// UpdateForRemovePolicy does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForRemovePolicy(sec, ptype string, params ...string) error {
+	return nil
+}
+
+// UpdateForRemoveFilteredPolicy does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForRemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
+	return nil
+}
+
+// UpdateForSavePolicy does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForSavePolicy(model model.Model) error {
+	return nil
+}
+
+// UpdateForAddPolicies does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForAddPolicies(sec string, ptype string, rules ...[]string) error {
+	return nil
+}
+
+// UpdateForRemovePolicies does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForRemovePolicies(sec string, ptype string, rules ...[]string) error {
+	return nil
+}
+
+// UpdateForUpdatePolicy does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForUpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return nil
+}
+
+// UpdateForUpdatePolicies does nothing, the change has been recorded by the adapter.
+func (w *Watcher) UpdateForUpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return nil
+}
+
+// Close stops and releases the watcher, the callback function will not be called any more.
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		w.adapter.watcherMu.Lock()
+		if w.adapter.watcher == w {
+			w.adapter.watcher = nil
+		}
+		w.adapter.watcherMu.Unlock()
+		close(w.stop)
+		<-w.done
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xormadapter
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestWatcher(t *testing.T) {
+	dataSourceName := filepath.Join(t.TempDir(), "casbin.db")
+	a1, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	a2, err := NewAdapter("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to create adapter, err: %v", err)
+	}
+	initPolicy(t, a1)
+
+	w1, err := NewWatcher(a1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create watcher, err: %v", err)
+	}
+	defer w1.Close()
+	w2, err := NewWatcher(a2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create watcher, err: %v", err)
+	}
+	defer w2.Close()
+
+	e1, _ := casbin.NewEnforcer("examples/rbac_model.conf", a1)
+	e2, _ := casbin.NewEnforcer("examples/rbac_model.conf", a2)
+
+	updated1 := make(chan string, 10)
+	if err = e1.SetWatcher(w1); err != nil {
+		t.Fatalf("SetWatcher failed, err: %v", err)
+	}
+	_ = w1.SetUpdateCallback(func(msg string) { updated1 <- msg })
+
+	updated2 := make(chan string, 10)
+	if err = e2.SetWatcher(w2); err != nil {
+		t.Fatalf("SetWatcher failed, err: %v", err)
+	}
+	_ = w2.SetUpdateCallback(func(msg string) {
+		_ = e2.LoadPolicy()
+		updated2 <- msg
+	})
+
+	if _, err = e1.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("AddPolicy failed, err: %v", err)
+	}
+
+	select {
+	case <-updated2:
+	case <-time.After(time.Second):
+		t.Fatal("the other instance was not notified of the change")
+	}
+	if !e2.HasPolicy("carol", "data3", "read") {
+		t.Error("the other instance should have reloaded the policy")
+	}
+
+	select {
+	case <-updated1:
+		t.Error("the instance making the change should not be notified")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A record committed after the last poll is seen, even with a lower id than the polled ones.
+	session := a1.engine.NewSession()
+	defer session.Close()
+	if err = session.Begin(); err != nil {
+		t.Fatalf("failed to begin the transaction, err: %v", err)
+	}
+	seq, err := a1.nextSeq(session, seqWatcher, 1)
+	if err != nil {
+		t.Fatalf("failed to number the record, err: %v", err)
+	}
+	if _, err = session.InsertOne(&watcherRecord{Id: -1, Seq: seq, Instance: "other", tableName: w2.tableName}); err != nil {
+		t.Fatalf("failed to insert the record, err: %v", err)
+	}
+	if err = session.Commit(); err != nil {
+		t.Fatalf("failed to commit the record, err: %v", err)
+	}
+	select {
+	case <-updated2:
+	case <-time.After(time.Second):
+		t.Fatal("the record committed late was missed")
+	}
+}